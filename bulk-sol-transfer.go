@@ -2,260 +2,375 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"sync"
-	"time"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"bulk-sol-transfer/bulktransfer"
 
-	"github.com/gagliardetto/solana-go"
 	"github.com/gagliardetto/solana-go/rpc"
 	"github.com/spf13/viper"
 )
 
-type Config struct {
-	RpcURL    string                `mapstructure:"rpc_url"`
-	Transfers []TransferInstruction `mapstructure:"transfers"`
-}
-
-type TransferInstruction struct {
-	FromPrivateKey string `mapstructure:"from_private_key"`
-	ToAddress      string `mapstructure:"to_address"`
-	Amount         uint64 `mapstructure:"amount"`
-}
-
-type TransferResult struct {
-	FromAccount    string
-	ToAccount      string
-	Amount         uint64
-	Signature      string
-	Status         string
-	ProcessingTime time.Duration
-	Error          error
-}
-
-func loadConfig() (*Config, error) {
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
-
-	if err := viper.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("error reading config file: %w", err)
+func main() {
+	rpcURL := flag.String("rpc-url", "", "RPC endpoint, overriding rpc_url")
+	debugRPC := flag.Bool("debug-rpc", false, "log the raw JSON of every RPC request and response (API keys in URLs redacted)")
+	replayPath := flag.String("replay", "", "re-check the signatures in a previous JSON output and print updated statuses")
+	estimateOnly := flag.Bool("estimate", false, "estimate fees and required balances without sending")
+	explain := flag.Bool("explain", false, "print a decoded view of every transaction without sending")
+	createATAsOnly := flag.Bool("create-atas-only", false, "create the missing associated token accounts of token transfer recipients, without transferring")
+	partialSign := flag.Bool("partial-sign", false, "sign with the available keys only and print each transaction with its missing signers, without sending")
+	transfersGlob := flag.String("transfers-glob", "", "also load transfers from every file matching this glob, e.g. \"payouts/*.yaml\"")
+	transfersMsgpack := flag.String("transfers-msgpack", "", "also send the transfers of this MessagePack file of transfer records, read and sent in batches of msgpack_batch_size, for very large lists")
+	onlyIndex := flag.Int("only-index", -1, "send only the transfer at this index to test the pipeline end to end")
+	first := flag.Bool("first", false, "send only the first transfer (same as -only-index 0)")
+	retryIndices := flag.String("retry-indices", "", "comma-separated transfer indices to send, e.g. 3,7,12, skipping all others")
+	failuresOnly := flag.Bool("failures-only", false, "print only failed and cancelled transfers; statistics still cover every transfer")
+	submitOnly := flag.Bool("submit-only", false, "return once every transfer is sent and confirm them in a background process that updates the state file")
+	confirmSubmitted := flag.Bool("confirm-submitted", false, "confirm the transfers the state file has as submitted and record their outcome")
+	manifestPath := flag.String("manifest", "", "write a JSON manifest of the run (config hash, version, endpoints, timing, record files) to this path")
+	verifyKeysPath := flag.String("verify-keys", "", "check offline that every transfer's key controls the address in this CSV of id,expected_address, without sending")
+	sqlitePath := flag.String("sqlite", "", "also insert every result into this SQLite database, tagged with the run id")
+	outputPath := flag.String("output", "", "write every result to this file as a JSON array (.json, readable by -replay) or CSV (.csv)")
+	expectPath := flag.String("expect", "", "compare each transfer's final status against this JSON file and exit non-zero on any difference")
+	decodePath := flag.String("decode", "", "print the decoded structure of the base64 transaction in this file and exit, offline and without config")
+	concurrencyFlag := flag.Int("concurrency", 0, "maximum number of transfers in flight, overriding max_concurrency (default 20)")
+	retryConfigPath := flag.String("emit-retry-config", "", "write a YAML config with this run's settings and only the transfers that did not confirm, keys included, to this new file")
+	plain := flag.Bool("plain", false, "print ASCII markers instead of emoji (default when stdout is not a terminal)")
+	flag.BoolVar(plain, "no-emoji", false, "same as -plain")
+	flag.Parse()
+
+	bulktransfer.PlainOutput = *plain || !isTerminal(os.Stdout)
+
+	if *decodePath != "" {
+		if err := bulktransfer.DecodeTransactionFile(*decodePath); err != nil {
+			log.Fatalf("Decode failed: %v", err)
+		}
+		return
 	}
 
-	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
-		return nil, fmt.Errorf("unable to decode config into struct: %w", err)
+	if *first {
+		*onlyIndex = 0
 	}
-
-	return &config, nil
-}
-
-func executeTransfer(client *rpc.Client, transfer TransferInstruction, wg *sync.WaitGroup, results chan<- TransferResult) {
-	defer wg.Done()
-
-	result := TransferResult{
-		Amount: transfer.Amount,
+	if *onlyIndex >= 0 && *retryIndices != "" {
+		log.Fatalf("-only-index/-first and -retry-indices cannot be combined")
 	}
 
-	startTime := time.Now()
-
-	// Decode private key
-	privateKeyBytes, err := base64.StdEncoding.DecodeString(transfer.FromPrivateKey)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to decode private key: %w", err)
-		results <- result
-		return
+	if *rpcURL != "" {
+		viper.Set("rpc_url", *rpcURL)
+	}
+	if *submitOnly && *confirmSubmitted {
+		log.Fatalf("-submit-only and -confirm-submitted cannot be combined")
+	}
+	if ext := filepath.Ext(*retryConfigPath); *retryConfigPath != "" && ext != ".yaml" && ext != ".yml" {
+		log.Fatalf("-emit-retry-config must name a .yaml or .yml file")
+	}
+	if ext := filepath.Ext(*outputPath); *outputPath != "" && ext != ".json" && ext != ".csv" {
+		log.Fatalf("-output must name a .json or .csv file")
 	}
 
-	// Create account from private key
-	account := solana.NewAccountFromPrivateKeyBytes(privateKeyBytes)
-	result.FromAccount = account.PublicKey().String()
-
-	// Parse destination address
-	destination, err := solana.PublicKeyFromBase58(transfer.ToAddress)
+	// Load configuration
+	config, err := bulktransfer.LoadConfig()
 	if err != nil {
-		result.Error = fmt.Errorf("invalid destination address: %w", err)
-		results <- result
-		return
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if *debugRPC {
+		config.DebugRPC = true
 	}
-	result.ToAccount = destination.String()
 
-	// Get recent blockhash
-	recentBlockhash, err := client.GetRecentBlockhash(context.Background(), rpc.CommitmentFinalized)
+	// Transfers from -transfers-glob and keypair_dir; those of
+	// -transfers-msgpack are read a batch at a time
+	stream, err := bulktransfer.LoadTransfers(config, *transfersGlob, *transfersMsgpack)
 	if err != nil {
-		result.Error = fmt.Errorf("failed to get recent blockhash: %w", err)
-		results <- result
-		return
+		log.Fatalf("Failed to load transfers: %v", err)
+	}
+	defer stream.Close()
+	if stream != nil {
+		for name, set := range map[string]bool{
+			"-only-index/-first": *onlyIndex >= 0, "-retry-indices": *retryIndices != "",
+			"-verify-keys": *verifyKeysPath != "", "-expect": *expectPath != "", "-output": *outputPath != "",
+			"-manifest": *manifestPath != "", "-emit-retry-config": *retryConfigPath != "",
+		} {
+			if set {
+				log.Fatalf("%s needs the whole transfer list and cannot be combined with -transfers-msgpack", name)
+			}
+		}
 	}
 
-	// Create transfer instruction
-	instruction := solana.NewTransferInstruction(
-		transfer.Amount,
-		account.PublicKey(),
-		destination,
-	).Build()
-
-	// Create transaction
-	tx, err := solana.NewTransaction(
-		[]solana.Instruction{instruction},
-		recentBlockhash.Value.Blockhash,
-		solana.TransactionPayer(account.PublicKey()),
-	)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to create transaction: %w", err)
-		results <- result
-		return
+	if len(config.Transfers) == 0 && stream == nil && *replayPath == "" {
+		log.Fatalf("Invalid configuration: no transfers (config.yaml, -transfers-glob, -transfers-msgpack or keypair_dir)")
 	}
 
-	// Sign transaction
-	_, err = tx.Sign(
-		func(key solana.PublicKey) *solana.PrivateKey {
-			if account.PublicKey().Equals(key) {
-				return &account.PrivateKey
-			}
-			return nil
-		},
-	)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to sign transaction: %w", err)
-		results <- result
-		return
+	if err := bulktransfer.ValidateTransfers(config); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	// Send transaction
-	sig, err := client.SendTransactionWithOpts(
-		context.Background(),
-		tx,
-		rpc.TransactionOpts{
-			SkipPreflight:       false,
-			PreflightCommitment: rpc.CommitmentFinalized,
-		},
-	)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to send transaction: %w", err)
-		results <- result
+	// Read-only and offline, so it runs before anything touches the network
+	if *verifyKeysPath != "" {
+		if err := bulktransfer.VerifyKeys(config.Transfers, *verifyKeysPath); err != nil {
+			log.Fatalf("Key verification failed: %v", err)
+		}
+		fmt.Printf("All %d transfer keys control their expected addresses\n", len(config.Transfers))
 		return
 	}
-	result.Signature = sig.String()
 
-	// Check transaction status
-	for {
-		status, err := client.GetSignatureStatuses(
-			context.Background(),
-			[]solana.Signature{sig},
-		)
+	var expected map[string]string
+	if *expectPath != "" {
+		expected, err = bulktransfer.LoadExpectations(*expectPath)
 		if err != nil {
-			result.Error = fmt.Errorf("failed to get transaction status: %w", err)
-			results <- result
-			return
+			log.Fatalf("Failed to load expectations: %v", err)
 		}
+	}
 
-		if status.Value[0] != nil {
-			if status.Value[0].Err != nil {
-				result.Status = "Failed"
-				result.Error = fmt.Errorf("transaction failed: %v", status.Value[0].Err)
-			} else {
-				result.Status = "Confirmed"
-			}
-			break
+	// Test a single representative transfer, leaving the rest untouched
+	if *onlyIndex >= 0 {
+		selected, err := bulktransfer.SelectTransfers(config.Transfers, []int{*onlyIndex})
+		if err != nil {
+			log.Fatalf("Invalid -only-index: %v", err)
 		}
+		fmt.Printf("Sending only transfer %d (id %s) of %d\n", *onlyIndex, selected[0].ID, len(config.Transfers))
+		config.Transfers = selected
+	}
 
-		// Wait a bit before checking again
-		time.Sleep(500 * time.Millisecond)
+	// Targeted re-send of specific entries
+	if *retryIndices != "" {
+		indices, err := bulktransfer.ParseIndices(*retryIndices)
+		if err != nil {
+			log.Fatalf("Invalid -retry-indices: %v", err)
+		}
+		selected, err := bulktransfer.SelectTransfers(config.Transfers, indices)
+		if err != nil {
+			log.Fatalf("Invalid -retry-indices: %v", err)
+		}
+		fmt.Printf("Sending only %d of %d transfers (indices %s)\n", len(selected), len(config.Transfers), *retryIndices)
+		config.Transfers = selected
 	}
 
-	result.ProcessingTime = time.Since(startTime)
-	results <- result
-}
+	// Ctrl+C or SIGTERM cancels in-flight work
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-func main() {
-	// Load configuration
-	config, err := loadConfig()
+	// Create RPC client
+	client, endpoints, err := bulktransfer.NewRPCClient(config)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		log.Fatalf("Failed to create RPC client: %v", err)
 	}
 
-	// Create RPC client
-	client := rpc.New(config.RpcURL)
+	if *replayPath != "" {
+		if err := bulktransfer.ReplayResults(ctx, client, *replayPath); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
 
-	// Create a wait group to wait for all transfers to complete
-	var wg sync.WaitGroup
-	results := make(chan TransferResult, len(config.Transfers))
+	// Both halves of a submit-only run track transfers through the state file
+	if (*submitOnly || *confirmSubmitted) && config.StateFile == "" {
+		log.Fatalf("Invalid configuration: -submit-only and -confirm-submitted require state_file")
+	}
+	if *confirmSubmitted {
+		if err := bulktransfer.ConfirmSubmitted(ctx, client, config); err != nil {
+			log.Fatalf("Background confirmation failed: %v", err)
+		}
+		return
+	}
 
-	// Start time measurement
-	startTime := time.Now()
+	reporter := &bulktransfer.Reporter{FailuresOnly: *failuresOnly}
+	transferrer := bulktransfer.New(client, bulktransfer.Options{
+		Config:      config,
+		Concurrency: *concurrencyFlag,
+		Endpoints:   endpoints,
+		SubmitOnly:  *submitOnly,
+		SQLitePath:  *sqlitePath,
+		Progress:    os.Stdout,
+		OnResult:    reporter.Result,
+		OnDeferred:  reporter.Deferred,
+	})
+
+	// Without -transfers-msgpack there is a single batch of every transfer
+	var summary bulktransfer.Summary
+	var results []bulktransfer.TransferResult
+	given := 0
+	transfers := config.Transfers
+	for batch := 1; ; batch++ {
+		if stream != nil {
+			next, err := stream.Next()
+			if err != nil {
+				log.Fatalf("Failed to load transfers: %v", err)
+			}
+			// The transfers of config.yaml lead the first batch
+			if batch == 1 {
+				next = append(transfers, next...)
+			}
+			if len(next) == 0 {
+				break
+			}
+			transfers = next
+			fmt.Printf("\nBatch %d: transfers %d-%d\n", batch, given, given+len(transfers)-1)
+		}
+		given += len(transfers)
 
-	fmt.Printf("Starting bulk transfer of %d transactions...\n", len(config.Transfers))
+		switch {
+		case *estimateOnly:
+			if err := transferrer.Estimate(ctx, transfers); err != nil {
+				log.Fatalf("Estimate failed: %v", err)
+			}
+		case *explain:
+			if err := transferrer.Explain(ctx, transfers); err != nil {
+				log.Fatalf("Explain failed: %v", err)
+			}
+		case *partialSign:
+			if err := transferrer.PartialSign(ctx, transfers); err != nil {
+				log.Fatalf("Partial signing failed: %v", err)
+			}
+		case *createATAsOnly:
+			if err := transferrer.CreateATAs(ctx, transfers); err != nil {
+				log.Fatalf("Creating token accounts failed: %v", err)
+			}
+		default:
+			results, err = transferrer.Run(ctx, transfers)
+			if err != nil {
+				log.Fatalf("Bulk transfer failed: %v", err)
+			}
 
-	// Execute transfers in parallel
-	for _, transfer := range config.Transfers {
-		wg.Add(1)
-		go executeTransfer(client, transfer, &wg, results)
-	}
+			// Written first so the results survive any non-zero exit below
+			if *outputPath != "" {
+				if err := bulktransfer.WriteResults(*outputPath, results); err != nil {
+					log.Printf("Warning: %v", err)
+				} else {
+					fmt.Printf("Results written to %s\n", *outputPath)
+				}
+			}
 
-	// Wait for all transfers to complete in a separate goroutine
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+			summary.Add(transferrer.Report(ctx, results))
 
-	// Collect results
-	var successCount, failCount int
-	var totalProcessingTime time.Duration
-	var minTime, maxTime time.Duration
-	var allResults []TransferResult
+			if *manifestPath != "" {
+				if err := transferrer.WriteManifest(*manifestPath, *outputPath, results); err != nil {
+					log.Printf("Warning: %v", err)
+				} else {
+					fmt.Printf("Manifest written to %s\n", *manifestPath)
+				}
+			}
 
-	fmt.Println("\nTransaction Results:")
-	fmt.Println("====================")
+			if *retryConfigPath != "" {
+				count, sent, err := transferrer.WriteRetryConfig(*retryConfigPath, results)
+				if err != nil {
+					log.Printf("Warning: %v", err)
+				} else {
+					fmt.Printf("Retry config with %d transfers written to %s\n", count, *retryConfigPath)
+					log.Printf("Warning: %s contains private keys, keep it safe and delete it when done", *retryConfigPath)
+					if sent > 0 {
+						log.Printf("Warning: %d of them were sent and may still land, check their signatures before re-running", sent)
+					}
+				}
+			}
 
-	for result := range results {
-		allResults = append(allResults, result)
+			// Upgrade the audit record to finalized now that results are reported
+			if config.FinalizeInBackground && config.Commitment != string(rpc.CommitmentFinalized) {
+				notFinalized, err := transferrer.Finalize(ctx, results)
+				if err != nil {
+					log.Printf("Warning: %v", err)
+				} else if notFinalized > 0 {
+					log.Printf("Warning: %d transfers were not finalized in time", notFinalized)
+				}
+			}
+		}
 
-		// Initialize minTime with the first result
-		if minTime == 0 {
-			minTime = result.ProcessingTime
+		if stream == nil || ctx.Err() != nil {
+			break
 		}
+	}
+	if *estimateOnly || *explain || *partialSign || *createATAsOnly {
+		return
+	}
 
-		// Update min and max times
-		if result.ProcessingTime < minTime {
-			minTime = result.ProcessingTime
+	// Hand the submitted transfers over to a confirmer that outlives this run
+	if summary.Submitted > 0 {
+		logPath := config.StateFile + ".confirm.log"
+		pid, err := startBackgroundConfirmer(logPath)
+		if err != nil {
+			log.Printf("Warning: failed to start background confirmation, run with -confirm-submitted: %v", err)
+		} else {
+			fmt.Printf("\nConfirming %d transfers in background process %d, logging to %s\n", summary.Submitted, pid, logPath)
 		}
-		if result.ProcessingTime > maxTime {
-			maxTime = result.ProcessingTime
+	}
+
+	// Against an expectations file, only a difference is a failure
+	if expected != nil {
+		diffs := bulktransfer.DiffExpectations(expected, results)
+		if len(diffs) > 0 {
+			fmt.Printf("\nExpectation Mismatches: %d\n", len(diffs))
+			fmt.Println("======================")
+			for _, diff := range diffs {
+				fmt.Printf("   %s\n", diff)
+			}
+			os.Exit(1)
 		}
+		fmt.Printf("\nAll %d transfers matched %s\n", len(expected), *expectPath)
+		return
+	}
 
-		totalProcessingTime += result.ProcessingTime
+	// Exit with error if any transaction failed (or too many, with
+	// min_success_rate), balances did not reconcile or results are missing
+	if summary.BelowSuccessRate || summary.BalanceMismatches > 0 || len(summary.NoResult) > 0 {
+		os.Exit(1)
+	}
 
-		if result.Error != nil {
-			failCount++
-			fmt.Printf("❌ From: %s\n   To: %s\n   Amount: %d lamports\n   Error: %v\n\n", 
-				result.FromAccount, result.ToAccount, result.Amount, result.Error)
-		} else {
-			successCount++
-			fmt.Printf("✅ From: %s\n   To: %s\n   Amount: %d lamports\n   Signature: %s\n   Processing Time: %v\n\n", 
-				result.FromAccount, result.ToAccount, result.Amount, result.Signature, result.ProcessingTime)
+	if summary.Unconfirmed > 0 {
+		if config.FailOnUnconfirmed {
+			os.Exit(1)
 		}
+		log.Printf("Warning: %d transfers were sent but never confirmed, check them before resending", summary.Unconfirmed)
 	}
 
-	// Calculate total time
-	totalTime := time.Since(startTime)
-	avgProcessingTime := totalProcessingTime / time.Duration(len(config.Transfers))
+	// An interrupted run is incomplete even without failures
+	if summary.Cancelled > 0 {
+		os.Exit(130)
+	}
+
+	// Nothing was sent at all, which is not the same as everything succeeding
+	if given > 0 && summary.Transfers == 0 {
+		log.Printf("Warning: all %d transfers were skipped, nothing was sent", given)
+		os.Exit(config.AllSkippedExitCode)
+	}
+}
 
-	// Print statistics
-	fmt.Println("\nTransaction Statistics:")
-	fmt.Println("======================")
-	fmt.Printf("Total Transactions: %d\n", len(config.Transfers))
-	fmt.Printf("Successful: %d\n", successCount)
-	fmt.Printf("Failed: %d\n", failCount)
-	fmt.Printf("Total Time: %v\n", totalTime)
-	fmt.Printf("Minimum Processing Time: %v\n", minTime)
-	fmt.Printf("Maximum Processing Time: %v\n", maxTime)
-	fmt.Printf("Average Processing Time: %v\n", avgProcessingTime)
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
-	// Exit with error if any transaction failed
-	if failCount > 0 {
-		os.Exit(1)
+// startBackgroundConfirmer re-runs this command with -confirm-submitted in
+// place of -submit-only, logging to logPath, and returns without waiting for
+// it so the confirmer outlives this process.
+func startBackgroundConfirmer(logPath string) (int, error) {
+	args := []string{"-confirm-submitted"}
+	for _, arg := range os.Args[1:] {
+		name := strings.TrimLeft(arg, "-")
+		if name == "submit-only" || strings.HasPrefix(name, "submit-only=") {
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open log: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		return 0, err
 	}
+	pid := cmd.Process.Pid
+	return pid, cmd.Process.Release()
 }
@@ -0,0 +1,7007 @@
+// Package bulktransfer sends batches of SOL and SPL token transfers
+// described by a Config and reports their results. The bulk-sol-transfer
+// command is a thin wrapper around it: New(client, opts).Run(ctx, transfers)
+// sends a batch and returns one TransferResult per transfer.
+package bulktransfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"solanakey"
+
+	bin "github.com/gagliardetto/binary"
+	"github.com/gagliardetto/solana-go"
+	computebudget "github.com/gagliardetto/solana-go/programs/compute-budget"
+	"github.com/gagliardetto/solana-go/programs/system"
+	"github.com/gagliardetto/solana-go/rpc"
+	"github.com/gagliardetto/solana-go/rpc/jsonrpc"
+	"github.com/gagliardetto/solana-go/rpc/ws"
+	"github.com/spf13/viper"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/crypto/pbkdf2"
+	"gopkg.in/yaml.v3"
+	_ "modernc.org/sqlite"
+)
+
+// statusPollInterval is how often a transfer polls for its signature status
+// at confirmed commitment; see pollInterval for the others. Each in-flight
+// transfer therefore costs about 1/pollInterval requests per second, which is
+// what the concurrency guard budgets against.
+const statusPollInterval = 500 * time.Millisecond
+
+// Version is the tool version, set at build time with
+// -ldflags "-X bulk-sol-transfer/bulktransfer.Version=v1.2.3".
+var Version = "dev"
+
+// defaultMaxConcurrency is the number of transfer workers unless
+// max_concurrency or -concurrency says otherwise.
+const defaultMaxConcurrency = 20
+
+// defaultResultBuffer caps the results channel of large runs unless
+// result_buffer_size says otherwise.
+const defaultResultBuffer = 1024
+
+type Config struct {
+	RpcURL    string                `mapstructure:"rpc_url"`
+	Transfers []TransferInstruction `mapstructure:"transfers"`
+
+	// How from_private_key and fee_payer_keys are given: base64, base58 (as
+	// exported by Phantom), file (path of a Solana CLI keypair file) or auto
+	// (default), which tells them apart
+	KeyFormat string `mapstructure:"key_format"`
+
+	// BIP39 mnemonic (and optional passphrase) whose child keys at
+	// m/44'/501'/<index>'/0' are used by transfers with from_derivation_index
+	Mnemonic           string `mapstructure:"mnemonic"`
+	MnemonicPassphrase string `mapstructure:"mnemonic_passphrase"`
+
+	// Senders as Solana CLI keypair files in keypair_dir, paired with
+	// recipients by keypair_mapping, a CSV of keypair_file,to_address,amount
+	KeypairDir     string `mapstructure:"keypair_dir"`
+	KeypairMapping string `mapstructure:"keypair_mapping"`
+
+	// Records of -transfers-msgpack read and sent per batch, so that memory
+	// stays bounded however long the file is (default 10000)
+	MsgpackBatchSize int `mapstructure:"msgpack_batch_size"`
+
+	// Additional endpoints to fail over to when rpc_url errors
+	RpcURLs []string `mapstructure:"rpc_urls"`
+	// Caps on the requests in flight to individual endpoints (rpc_url or
+	// one of rpc_urls). A request skips an endpoint at its cap for the next
+	// one, and waits only when every endpoint is at its cap.
+	EndpointLimits []EndpointLimit `mapstructure:"endpoint_limits"`
+
+	// Endpoints every transaction is also sent to, in parallel with
+	// rpc_url, to improve its chances of landing under congestion. Status
+	// polling and all other reads still go through rpc_url.
+	BroadcastEndpoints []string `mapstructure:"broadcast_endpoints"`
+
+	// Log the raw JSON of every RPC request and response, with API keys in
+	// endpoint URLs redacted. Very verbose; for diagnosing provider issues.
+	DebugRPC bool `mapstructure:"debug_rpc"`
+
+	// Before sending, sample the node's slot over this window and abort if
+	// it is not advancing (0 = skip the check)
+	SlotCheckWindowMs int `mapstructure:"slot_check_window_ms"`
+
+	// HTTP connection pool for RPC calls (0 = defaults: 9 connections per
+	// host, 180s keep-alive; negative keep-alive disables it)
+	MaxIdleConns        int `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost int `mapstructure:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int `mapstructure:"max_conns_per_host"`
+	KeepAliveSeconds    int `mapstructure:"keep_alive_seconds"`
+
+	// Maximum number of transfers in flight (default 20), overridden by
+	// the -concurrency flag
+	MaxConcurrency int `mapstructure:"max_concurrency"`
+	// Requests per second allowed against rpc_url (0 = unlimited)
+	RateLimit float64 `mapstructure:"rate_limit_rps"`
+	// Lower MaxConcurrency to what RateLimit can sustain instead of only warning
+	AutoClampConcurrency bool `mapstructure:"auto_clamp_concurrency"`
+	// Adapt the rate instead (AIMD): starting at RateLimit (default 10),
+	// add AdaptiveRateStep req/s (default 1) each second without a 429 and
+	// halve it on a 429, staying within AdaptiveRateMin (default 1) and
+	// AdaptiveRateMax (default 10x the starting rate)
+	AdaptiveRate     bool    `mapstructure:"adaptive_rate"`
+	AdaptiveRateMin  float64 `mapstructure:"adaptive_rate_min"`
+	AdaptiveRateMax  float64 `mapstructure:"adaptive_rate_max"`
+	AdaptiveRateStep float64 `mapstructure:"adaptive_rate_step"`
+
+	// Throttle sends (not other requests) by confirmation latency: while the
+	// average of the last LatencyWindow (default 20) confirmations exceeds
+	// LatencyThresholdMs the send rate halves, down to LatencySendRateMin
+	// (default 1/s); below half the threshold it grows again by 1/s per
+	// second up to 10x LatencySendRate, the starting rate (default 10/s)
+	LatencyThresholdMs int     `mapstructure:"latency_threshold_ms"`
+	LatencyWindow      int     `mapstructure:"latency_window"`
+	LatencySendRate    float64 `mapstructure:"latency_send_rate"`
+	LatencySendRateMin float64 `mapstructure:"latency_send_rate_min"`
+
+	// Results buffered between the transfers and the reporting loop
+	// (default min(transfers, 1024)). When it is full, finished transfers
+	// wait, holding their concurrency slot, so a slow consumer such as the
+	// SQLite sink throttles dispatch instead of growing memory.
+	ResultBufferSize int `mapstructure:"result_buffer_size"`
+
+	// Dispatch transfers in random order so on-chain timing does not reveal
+	// the list order; a non-zero ShuffleSeed makes the order reproducible
+	Shuffle     bool  `mapstructure:"shuffle"`
+	ShuffleSeed int64 `mapstructure:"shuffle_seed"`
+
+	// Send in sequential chunks of this many transfers, pausing between
+	// chunks (0 = one chunk). Each chunk finishes, and is in the state file,
+	// before the next starts.
+	ChunkSize         int `mapstructure:"chunk_size"`
+	ChunkDelaySeconds int `mapstructure:"chunk_delay_seconds"`
+
+	// Shared blockhash cache: "" fetches per transfer, "interval" refreshes on
+	// a timer, "slot" refreshes on websocket slot notifications
+	BlockhashCache          string `mapstructure:"blockhash_cache"`
+	BlockhashRefreshSeconds int    `mapstructure:"blockhash_refresh_seconds"`
+	BlockhashRefreshSlots   uint64 `mapstructure:"blockhash_refresh_slots"`
+	WsURL                   string `mapstructure:"ws_url"`
+	// Refresh the cached blockhash early once it is within this many blocks
+	// of expiring (0 = use it until the next scheduled refresh)
+	BlockhashExpiryBuffer uint64 `mapstructure:"blockhash_expiry_buffer"`
+
+	// Abort if the transfers use more distinct sender keys than this
+	// (0 = no limit), as a guard against pointing a run at many hot wallets
+	MaxSenders int `mapstructure:"max_senders"`
+
+	// What to do when a transfer funds a new account below the rent-exempt
+	// minimum: "" skips the check, "warn" logs it, "fail" rejects the transfer
+	RentExemptCheck string `mapstructure:"rent_exempt_check"`
+	// Lower a SOL transfer's amount when it would leave the sender with a
+	// balance above zero but below the rent-exempt minimum, which the
+	// runtime rejects with InsufficientFundsForRent. The sender's balance is
+	// read once and each transfer checks it net of what the sender's other
+	// transfers in the run spend
+	KeepSenderRentExempt bool `mapstructure:"keep_sender_rent_exempt"`
+
+	// Zero-amount transfers are usually a templating mistake but still pay a
+	// fee: "reject" (default) fails validation, "warn" only logs them
+	ZeroAmount string `mapstructure:"zero_amount"`
+
+	// Maximum size of a transfer's memo in bytes (default 256)
+	MaxMemoBytes int `mapstructure:"max_memo_bytes"`
+
+	// Memo attached to every transaction of the run, e.g. "payroll-2024-06",
+	// ahead of any per-transfer memo. It adds about len(run_memo)+5 bytes
+	// (plus 32 for the Memo program id when there is no other memo) and some
+	// compute units, but no signature, so the base fee is unchanged.
+	RunMemo string `mapstructure:"run_memo"`
+
+	// Attach a memo with a per-transfer nonce so identical transfers (same
+	// sender, recipient and amount) get distinct signatures. Costs roughly
+	// 80 bytes of transaction size and a few hundred compute units; the base
+	// fee is unchanged since no signature is added.
+	UniqueMemo bool `mapstructure:"unique_memo"`
+
+	// Attach a memo "seq:<run id>:<n>:<RFC 3339 time>" numbering the
+	// transfers in the order they are first signed, so the payout order can
+	// be proven from chain data. Costs about 100 bytes and a few hundred
+	// compute units; the memo proves signing order, while the order the
+	// network includes transactions in may still differ.
+	SequenceMemo bool `mapstructure:"sequence_memo"`
+
+	// Estimate each transaction's fee with getFeeForMessage before sending,
+	// and read the fee actually charged (meta.fee) after confirmation
+	EstimateFees bool `mapstructure:"estimate_fees"`
+	VerifyFees   bool `mapstructure:"verify_fees"`
+
+	// Read the compute units each confirmed transaction consumed
+	// (meta.computeUnitsConsumed) and summarize them, to size
+	// compute_unit_limit for later runs
+	ReportComputeUnits bool `mapstructure:"report_compute_units"`
+
+	// Break the run's time down into dispatch, confirmation and rate limit
+	// waits, in the statistics and the -manifest
+	ReportPhases bool `mapstructure:"report_phases"`
+
+	// Compute budget: priority fee in micro-lamports per compute unit and a
+	// fixed unit limit (0 = runtime default)
+	ComputeUnitPrice uint64 `mapstructure:"compute_unit_price"`
+	ComputeUnitLimit uint32 `mapstructure:"compute_unit_limit"`
+	// Size the unit limit per transaction from a simulation instead, adding
+	// ComputeUnitMarginPercent (default 10) on top of the units consumed
+	AutoComputeUnitLimit     bool `mapstructure:"auto_compute_unit_limit"`
+	ComputeUnitMarginPercent int  `mapstructure:"compute_unit_margin_percent"`
+
+	// Fail any transfer whose estimated fee, priority fee included, exceeds
+	// this many lamports instead of sending it (0 = no cap). Implies
+	// estimating every fee; a transfer whose fee can't be estimated fails.
+	MaxFeeLamports uint64 `mapstructure:"max_fee_lamports"`
+
+	// Commitment a transaction must reach to count as confirmed
+	// (processed, confirmed or finalized; default confirmed)
+	Commitment string `mapstructure:"commitment"`
+	// Commitment preflight simulation runs against (default: commitment)
+	PreflightCommitment string `mapstructure:"preflight_commitment"`
+	// Commitment for balance, account and fee reads (default: commitment)
+	ReadCommitment string `mapstructure:"read_commitment"`
+
+	// Success criteria on top of commitment: below finalized, also require
+	// this many confirmations (blocks built on top); and optionally check
+	// on-chain state after confirmation, "recipient_balance" requiring a
+	// SOL recipient to hold at least the amount sent
+	MinConfirmations uint64 `mapstructure:"min_confirmations"`
+	SuccessCheck     string `mapstructure:"success_check"`
+
+	// Have status polls search the ledger (searchTransactionHistory) rather
+	// than only the recent status cache, so signatures that aged out of it,
+	// e.g. in deferred or long-running confirmation, are still found. Slower.
+	SearchTransactionHistory bool `mapstructure:"search_transaction_history"`
+
+	// How to wait for confirmation: "poll" (default), "websocket" for
+	// signatureSubscribe, or "race" to run both and take the first
+	ConfirmVia string `mapstructure:"confirm_via"`
+
+	// Delay before the first status poll, since a status is rarely available
+	// right after sending, and between polls. Both default to values matched
+	// to the commitment, from 400ms/250ms at processed to 8s/2s at
+	// finalized; a negative grace disables it.
+	ConfirmationGraceMs  int `mapstructure:"confirmation_grace_ms"`
+	StatusPollIntervalMs int `mapstructure:"status_poll_interval_ms"`
+
+	// Stop waiting for a sent transaction after this long (default 60,
+	// negative disables) and report it as Timeout, which counts as
+	// unconfirmed since it may still land. An expired blockhash is only
+	// noticed and resent within this time.
+	ConfirmationTimeoutSeconds int `mapstructure:"confirmation_timeout_seconds"`
+
+	// Periodically log transfers that have been running longer than this
+	// (default 60, negative disables)
+	StuckTransferSeconds int `mapstructure:"stuck_transfer_seconds"`
+
+	// After reporting, keep polling confirmed transfers until they are
+	// finalized and record that in the state file
+	FinalizeInBackground   bool `mapstructure:"finalize_in_background"`
+	FinalizeTimeoutSeconds int  `mapstructure:"finalize_timeout_seconds"`
+
+	// With -submit-only, how long the background confirmer waits for the
+	// submitted transfers before leaving the rest as Submitted (default 120)
+	SubmitConfirmTimeoutSeconds int `mapstructure:"submit_confirm_timeout_seconds"`
+
+	// Sign all transfers up front but only broadcast once the cluster
+	// reaches this slot (0 = send immediately). Transfers with a
+	// nonce_account stay valid indefinitely; others are re-signed with a
+	// fresh blockhash if the wait outlives their blockhash.
+	SendAtSlot uint64 `mapstructure:"send_at_slot"`
+
+	// Shell command run (via sh -c) for every failed transfer, receiving
+	// the result as JSON on stdin and TRANSFER_* environment variables
+	OnFailureCommand        string `mapstructure:"on_failure_command"`
+	OnFailureTimeoutSeconds int    `mapstructure:"on_failure_timeout_seconds"`
+
+	// Count transfers that were sent but whose outcome never resolved as
+	// failures for the exit code; otherwise they are only reported
+	FailOnUnconfirmed bool `mapstructure:"fail_on_unconfirmed"`
+
+	// Percentage of attempted transfers that must confirm for the run to
+	// exit 0; failures below that are tolerated (0 = any failure fails)
+	MinSuccessRate float64 `mapstructure:"min_success_rate"`
+
+	// Exit code used when every transfer was skipped, so automation can tell
+	// "nothing to do" apart from "everything succeeded" (default 0)
+	AllSkippedExitCode int `mapstructure:"all_skipped_exit_code"`
+
+	// For transfers whose fee a separate fee_payer sponsors, add a transfer
+	// from the sender repaying the payer the transaction's estimated fee
+	// (base fee for both signatures plus the priority fee at the configured
+	// limit, or 200,000 units). Without it the fee is only accounted for in
+	// the -partial-sign output.
+	ReimburseSponsoredFees bool `mapstructure:"reimburse_sponsored_fees"`
+
+	// Send this small transfer first and only send the batch if it
+	// succeeds within its timeout
+	Canary *CanaryConfig `mapstructure:"canary"`
+
+	// Pool of fee payers (base64 private keys, like from_private_key) that
+	// pay for every transfer without its own fee_payer, one per
+	// transaction. fee_payer_selection is round_robin (default) or balance,
+	// which picks the payer with the most lamports left.
+	FeePayerKeys      []string `mapstructure:"fee_payer_keys"`
+	FeePayerSelection string   `mapstructure:"fee_payer_selection"`
+
+	// Resend a transfer with a fresh blockhash, up to this many times
+	// (default 2, negative disables), when its blockhash expires before the
+	// transaction is seen; past that height it can no longer land
+	ExpiryResends int `mapstructure:"expiry_resends"`
+
+	// Resend a transaction the node did not accept because of a transient
+	// error (network, timeout, node busy, blockhash not found) up to this
+	// many times, waiting 500ms before the first retry and twice as long
+	// before each next one; 0 (default) sends once
+	MaxRetries int `mapstructure:"max_retries"`
+
+	// Re-attempt transient failures that were never sent after the whole
+	// pass, up to this many rounds, waiting RetryRoundDelaySeconds (default
+	// 10) first
+	RetryRounds            int `mapstructure:"retry_rounds"`
+	RetryRoundDelaySeconds int `mapstructure:"retry_round_delay_seconds"`
+
+	// Explorer to link confirmed signatures to, e.g.
+	// https://explorer.solana.com or https://solscan.io, and the cluster
+	// query parameter it needs (empty for mainnet)
+	ExplorerBaseURL string `mapstructure:"explorer_base_url"`
+	ExplorerCluster string `mapstructure:"explorer_cluster"`
+
+	// Read the sender's balance after every confirmed transfer, at the cost
+	// of one extra RPC call each, to watch hot wallets drain during a run
+	ReportSenderBalance bool `mapstructure:"report_sender_balance"`
+
+	// After the run, re-read every sender's balance and check that it fell
+	// by its confirmed SOL amounts plus fees, allowing this much difference
+	// for unrelated activity on the account
+	ReconcileBalances          bool   `mapstructure:"reconcile_balances"`
+	ReconcileToleranceLamports uint64 `mapstructure:"reconcile_tolerance_lamports"`
+
+	// Append-only JSON lines file used to resume interrupted runs
+	StateFile string `mapstructure:"state_file"`
+
+	// Price source for transfers denominated in USD (usd_amount)
+	PriceSourceURL     string `mapstructure:"price_source_url"`
+	PriceJSONPath      string `mapstructure:"price_json_path"`
+	PriceTimestampPath string `mapstructure:"price_timestamp_path"`
+	PriceMaxAgeSeconds int    `mapstructure:"price_max_age_seconds"`
+}
+
+type TransferInstruction struct {
+	// Stable identifier used by the state file; defaults to the list index
+	ID             string `mapstructure:"id"`
+	Comment        string `mapstructure:"comment"`
+	FromPrivateKey string `mapstructure:"from_private_key"`
+	// Send from the mnemonic's child key at this index instead
+	FromDerivationIndex *uint32 `mapstructure:"from_derivation_index"`
+	ToAddress           string  `mapstructure:"to_address"`
+	Amount              uint64  `mapstructure:"amount"`
+	USDAmount           float64 `mapstructure:"usd_amount"`
+	// Send this percentage of the sender's balance at the start of the run,
+	// after setting aside its fixed amounts and every transaction's fee
+	Percent float64 `mapstructure:"percent"`
+	// Memo attached to the transfer via the Memo program
+	Memo string `mapstructure:"memo"`
+	// Durable nonce account (authority: the sender) to sign with instead of
+	// a recent blockhash
+	NonceAccount string `mapstructure:"nonce_account"`
+	// Fee payer that signs separately, e.g. an external co-signer; defaults
+	// to the sender. Such transfers can only be sent with -partial-sign.
+	FeePayer string `mapstructure:"fee_payer"`
+	// Send tokens of this mint instead of SOL; amount is in the mint's base
+	// units. Tokens go to the recipient's associated token account unless
+	// token_account names the recipient token account directly.
+	Mint         string `mapstructure:"mint"`
+	TokenAccount string `mapstructure:"token_account"`
+	// Commitment this transfer must reach, overriding the global one
+	Commitment string `mapstructure:"commitment"`
+	// Send the amount as this many separate transactions of near-equal
+	// parts, with ids "<id>/1" to "<id>/N"
+	SplitInto int `mapstructure:"split_into"`
+	// Wait this long before building and sending the transfer, on top of
+	// the rate limit
+	DelayBeforeMs int `mapstructure:"delay_before_ms"`
+	// Compute unit price and limit for this transfer instead of the global
+	// ones; a fixed limit also turns off auto_compute_unit_limit for it
+	ComputeUnitPrice uint64 `mapstructure:"compute_unit_price"`
+	ComputeUnitLimit uint32 `mapstructure:"compute_unit_limit"`
+	// Send only if the condition holds when the transfer starts:
+	// balance_below (condition_account has less than condition_lamports),
+	// account_exists or account_missing. condition_account defaults to the
+	// recipient; an unmet condition skips the transfer.
+	Condition         string `mapstructure:"condition"`
+	ConditionAccount  string `mapstructure:"condition_account"`
+	ConditionLamports uint64 `mapstructure:"condition_lamports"`
+
+	// Set on split parts, which would otherwise be identical transactions
+	uniqueMemo bool
+	// Number of the sequence memo, assigned on first build so resends keep it
+	sequence     uint64
+	sequenceTime time.Time
+}
+
+type TransferResult struct {
+	ID             string
+	FromAccount    string
+	ToAccount      string
+	Mint           string
+	Amount         uint64
+	Signature      string
+	Status         string
+	ProcessingTime time.Duration
+	Error          error
+
+	// Breakdown of ProcessingTime by phase
+	BlockhashTime time.Duration
+	SendTime      time.Duration
+	ConfirmTime   time.Duration
+
+	// USD/SOL rate used to compute Amount for usd_amount transfers
+	USDRate float64
+
+	// Commitment level the transaction had reached when last checked
+	ConfirmationStatus string
+	// Confirmation mechanism that observed it first ("poll" or "websocket")
+	ConfirmedVia string
+
+	// Fee from getFeeForMessage before sending and from meta.fee after
+	EstimatedFee uint64
+	Fee          uint64
+
+	// Explorer link for confirmed transactions, if explorer_base_url is set
+	ExplorerURL string
+
+	// Fee a separate fee_payer is estimated to pay for the transfer, and
+	// whether the sender repays it in the same transaction
+	SponsoredFee        uint64
+	SponsoredReimbursed bool
+
+	// Sender's SOL balance once the transfer confirmed, if
+	// report_sender_balance is set and the read succeeded
+	SenderBalanceAfter uint64
+	senderBalanceRead  bool
+
+	// Why the transfer was skipped, when its condition was not met or the
+	// state file has it as done
+	SkipReason string
+
+	// Number in the sequence memo, if sequence_memo is set
+	Sequence uint64
+
+	// Compute units the transaction consumed, if report_compute_units is
+	// set and the node reported them
+	ComputeUnits     uint64
+	computeUnitsRead bool
+
+	// Times the transfer was re-signed and resent because its blockhash
+	// expired before it landed
+	Resends int
+
+	// Times the transaction was sent, counting retries of transient send
+	// errors and resends after expiry
+	Attempts int
+
+	// Last block height at which the current transaction can land; zero for
+	// durable nonce transactions, which do not expire
+	lastValidBlockHeight uint64
+}
+
+// bindEnv lets every top-level setting come from a BULK_<KEY> environment
+// variable, e.g. BULK_RPC_URL, whether or not there is a config file.
+func bindEnv() {
+	viper.SetEnvPrefix("bulk")
+	config := reflect.TypeOf(Config{})
+	for i := 0; i < config.NumField(); i++ {
+		if key := config.Field(i).Tag.Get("mapstructure"); key != "" && key != "transfers" {
+			viper.BindEnv(key)
+		}
+	}
+}
+
+// LoadConfig reads config.yaml, if present, and BULK_* environment variables.
+// The file is optional as long as the required settings come from elsewhere.
+func LoadConfig() (*Config, error) {
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+	bindEnv()
+
+	if err := viper.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		log.Printf("No config.yaml found, using flags and environment only")
+	}
+
+	var config Config
+	if err := viper.Unmarshal(&config); err != nil {
+		return nil, fmt.Errorf("unable to decode config into struct: %w", err)
+	}
+
+	for i := range config.Transfers {
+		if config.Transfers[i].ID == "" {
+			config.Transfers[i].ID = strconv.Itoa(i)
+		}
+	}
+
+	if config.RpcURL == "" && len(config.RpcURLs) > 0 {
+		config.RpcURL = config.RpcURLs[0]
+	}
+	if config.RpcURL == "" {
+		return nil, fmt.Errorf("rpc_url is required (config.yaml, -rpc-url or BULK_RPC_URL)")
+	}
+
+	if config.Commitment == "" {
+		config.Commitment = string(rpc.CommitmentConfirmed)
+	}
+	if _, err := parseCommitment(config.Commitment); err != nil {
+		return nil, err
+	}
+	if config.PreflightCommitment == "" {
+		config.PreflightCommitment = config.Commitment
+	}
+	if _, err := parseCommitment(config.PreflightCommitment); err != nil {
+		return nil, fmt.Errorf("preflight_commitment: %w", err)
+	}
+	if config.ReadCommitment == "" {
+		config.ReadCommitment = config.Commitment
+	}
+	if _, err := parseCommitment(config.ReadCommitment); err != nil {
+		return nil, fmt.Errorf("read_commitment: %w", err)
+	}
+
+	switch config.ConfirmVia {
+	case "", "poll", "websocket", "race":
+	default:
+		return nil, fmt.Errorf("invalid confirm_via %q (expected poll, websocket or race)", config.ConfirmVia)
+	}
+
+	switch config.SuccessCheck {
+	case "", "recipient_balance":
+	default:
+		return nil, fmt.Errorf("invalid success_check %q (expected recipient_balance)", config.SuccessCheck)
+	}
+
+	switch config.RentExemptCheck {
+	case "", "warn", "fail":
+	default:
+		return nil, fmt.Errorf("invalid rent_exempt_check %q (expected warn or fail)", config.RentExemptCheck)
+	}
+
+	if config.MinSuccessRate < 0 || config.MinSuccessRate > 100 {
+		return nil, fmt.Errorf("min_success_rate must be between 0 and 100, got %v", config.MinSuccessRate)
+	}
+
+	if config.Canary != nil {
+		if config.Canary.ToAddress == "" || config.Canary.Amount == 0 {
+			return nil, fmt.Errorf("canary requires to_address and amount")
+		}
+		if _, err := solana.PublicKeyFromBase58(config.Canary.ToAddress); err != nil {
+			return nil, fmt.Errorf("invalid canary to_address: %w", err)
+		}
+	}
+
+	switch config.FeePayerSelection {
+	case "":
+		config.FeePayerSelection = "round_robin"
+	case "round_robin", "balance":
+	default:
+		return nil, fmt.Errorf("invalid fee_payer_selection %q (expected round_robin or balance)", config.FeePayerSelection)
+	}
+
+	switch config.ZeroAmount {
+	case "":
+		config.ZeroAmount = "reject"
+	case "reject", "warn":
+	default:
+		return nil, fmt.Errorf("invalid zero_amount %q (expected reject or warn)", config.ZeroAmount)
+	}
+
+	switch config.KeyFormat {
+	case "":
+		config.KeyFormat = "auto"
+	case "auto", "base64", "base58", "file":
+	default:
+		return nil, fmt.Errorf("invalid key_format %q (expected base64, base58, file or auto)", config.KeyFormat)
+	}
+
+	return &config, nil
+}
+
+// LoadTransfers adds to config's transfers those of every file matching
+// glob (if not empty) and of keypair_mapping, and resolves every sender's
+// key to base64. A MessagePack file at msgpackPath (if not empty) is opened
+// to be read in batches instead, with the key_format the config had.
+func LoadTransfers(config *Config, glob, msgpackPath string) (*MsgpackTransfers, error) {
+	// Merge transfers dropped into separate files
+	if glob != "" {
+		extra, files, err := loadTransferFiles(glob)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Loaded %d transfers from %d files matching %s\n", len(extra), files, glob)
+		config.Transfers = append(config.Transfers, extra...)
+	}
+
+	// Large lists in the compact binary format
+	var stream *MsgpackTransfers
+	if msgpackPath != "" {
+		var err error
+		stream, err = OpenMsgpackTransfers(msgpackPath, config.KeyFormat, config.MsgpackBatchSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Keypair files and derived keys below are already base64
+	if err := normalizeKeys(config); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	// Senders from a directory of keypair files
+	if config.KeypairDir != "" {
+		if config.KeypairMapping == "" {
+			stream.Close()
+			return nil, errors.New("keypair_dir requires keypair_mapping")
+		}
+		extra, err := loadKeypairMapping(config.KeypairDir, config.KeypairMapping)
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		fmt.Printf("Loaded %d transfers from %s with keys in %s\n", len(extra), config.KeypairMapping, config.KeypairDir)
+		config.Transfers = append(config.Transfers, extra...)
+	}
+
+	// Senders derived from the mnemonic
+	if err := resolveDerivedKeys(config, os.Stdout); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// loadTransferFiles reads the transfers list from every file matching pattern
+// and merges them in file name order. Transfers without an id get one derived
+// from their file and position so ids stay unique across files.
+func loadTransferFiles(pattern string) ([]TransferInstruction, int, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid transfers glob %q: %w", pattern, err)
+	}
+	if len(files) == 0 {
+		return nil, 0, fmt.Errorf("no files match %q", pattern)
+	}
+
+	var transfers []TransferInstruction
+	for _, file := range files {
+		v := viper.New()
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, 0, fmt.Errorf("error reading %s: %w", file, err)
+		}
+
+		var batch struct {
+			Transfers []TransferInstruction `mapstructure:"transfers"`
+		}
+		if err := v.Unmarshal(&batch); err != nil {
+			return nil, 0, fmt.Errorf("unable to decode %s: %w", file, err)
+		}
+
+		for i := range batch.Transfers {
+			if batch.Transfers[i].ID == "" {
+				batch.Transfers[i].ID = fmt.Sprintf("%s#%d", filepath.Base(file), i)
+			}
+		}
+		transfers = append(transfers, batch.Transfers...)
+	}
+
+	return transfers, len(files), nil
+}
+
+// defaultMsgpackBatchSize is how many MessagePack records are sent per
+// batch unless msgpack_batch_size says otherwise.
+const defaultMsgpackBatchSize = 10000
+
+// MsgpackTransfers reads transfers from a MessagePack file: a plain sequence
+// of maps, one per transfer, keyed like the YAML transfer fields (e.g.
+// {"to_address": "...", "amount": 1000}). Records are decoded one at a time
+// straight into TransferInstruction, so very large lists avoid the
+// intermediate document YAML and JSON parsing builds, and only the batch
+// being read is held in memory. Unknown keys are rejected to catch
+// misspelled fields.
+type MsgpackTransfers struct {
+	path      string
+	keyFormat string
+	batchSize int
+	file      *os.File
+	decoder   *msgpack.Decoder
+	// Records read so far, which numbers the transfers without an id
+	read int
+}
+
+// OpenMsgpackTransfers opens the MessagePack file at path, whose keys are
+// given in keyFormat, to be read batchSize transfers at a time (0 for the
+// default).
+func OpenMsgpackTransfers(path, keyFormat string, batchSize int) (*MsgpackTransfers, error) {
+	if batchSize <= 0 {
+		batchSize = defaultMsgpackBatchSize
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	decoder := msgpack.NewDecoder(bufio.NewReaderSize(file, 1<<20))
+	decoder.SetCustomStructTag("mapstructure")
+	decoder.DisallowUnknownFields(true)
+	return &MsgpackTransfers{path: path, keyFormat: keyFormat, batchSize: batchSize, file: file, decoder: decoder}, nil
+}
+
+// Next reads the next batch of transfers, with their keys resolved to
+// base64. It returns none at the end of the file.
+func (m *MsgpackTransfers) Next() ([]TransferInstruction, error) {
+	var transfers []TransferInstruction
+	for len(transfers) < m.batchSize {
+		var transfer TransferInstruction
+		if err := m.decoder.Decode(&transfer); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("record %d of %s: %w", m.read, m.path, err)
+		}
+		if transfer.ID == "" {
+			transfer.ID = fmt.Sprintf("%s#%d", filepath.Base(m.path), m.read)
+		}
+		m.read++
+		transfers = append(transfers, transfer)
+	}
+
+	batch := Config{Transfers: transfers, KeyFormat: m.keyFormat}
+	if err := normalizeKeys(&batch); err != nil {
+		return nil, fmt.Errorf("%s: %w", m.path, err)
+	}
+	return transfers, nil
+}
+
+// Close closes the file. It does nothing on a nil MsgpackTransfers.
+func (m *MsgpackTransfers) Close() error {
+	if m == nil {
+		return nil
+	}
+	return m.file.Close()
+}
+
+// defaultMaxMemoBytes keeps memos well clear of the transaction size limit.
+const defaultMaxMemoBytes = 256
+
+// loadKeypairMapping reads the keypair_mapping CSV and returns a transfer
+// per row, sent from the Solana CLI keypair file it names in dir. Every
+// referenced file is checked up front so that a missing key is reported
+// before anything is sent.
+func loadKeypairMapping(dir, mappingPath string) ([]TransferInstruction, error) {
+	file, err := os.Open(mappingPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keypair mapping: %w", err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keypair mapping %s: %w", mappingPath, err)
+	}
+	// Optional header
+	if len(rows) > 0 && len(rows[0]) > 0 && rows[0][0] == "keypair_file" {
+		rows = rows[1:]
+	}
+
+	var transfers []TransferInstruction
+	var problems []string
+	keys := make(map[string]string)
+	for i, row := range rows {
+		line := i + 1
+		if len(row) != 3 {
+			problems = append(problems, fmt.Sprintf("row %d: expected keypair_file,to_address,amount, got %d fields", line, len(row)))
+			continue
+		}
+		name, to := strings.TrimSpace(row[0]), strings.TrimSpace(row[1])
+		amount, err := strconv.ParseUint(strings.TrimSpace(row[2]), 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("row %d: invalid amount %q", line, row[2]))
+			continue
+		}
+
+		key, ok := keys[name]
+		if !ok {
+			key, err = readKeypairFile(filepath.Join(dir, name))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("row %d: %v", line, err))
+				continue
+			}
+			keys[name] = key
+		}
+
+		transfers = append(transfers, TransferInstruction{
+			ID:             fmt.Sprintf("%s#%d", filepath.Base(mappingPath), i),
+			FromPrivateKey: key,
+			ToAddress:      to,
+			Amount:         amount,
+		})
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%d invalid keypair mapping rows:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	return transfers, nil
+}
+
+// VerifyKeys checks, offline, that each transfer's private key derives to
+// the sender address expected for it in expectedPath, a CSV of
+// id,expected_address. It reports every mismatch, or transfer missing from
+// the file, with its index.
+func VerifyKeys(transfers []TransferInstruction, expectedPath string) error {
+	file, err := os.Open(expectedPath)
+	if err != nil {
+		return fmt.Errorf("failed to open expected keys: %w", err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to read expected keys %s: %w", expectedPath, err)
+	}
+	// Optional header
+	if len(rows) > 0 && len(rows[0]) > 0 && rows[0][0] == "id" {
+		rows = rows[1:]
+	}
+
+	var problems []string
+	expected := make(map[string]string, len(rows))
+	for i, row := range rows {
+		if len(row) != 2 {
+			problems = append(problems, fmt.Sprintf("row %d: expected id,expected_address, got %d fields", i+1, len(row)))
+			continue
+		}
+		expected[strings.TrimSpace(row[0])] = strings.TrimSpace(row[1])
+	}
+
+	for i, transfer := range transfers {
+		want, ok := expected[transfer.ID]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): no expected address", i, transfer.ID))
+			continue
+		}
+		privateKeyBytes, err := base64.StdEncoding.DecodeString(transfer.FromPrivateKey)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): failed to decode private key: %v", i, transfer.ID, err))
+			continue
+		}
+		got := solana.NewAccountFromPrivateKeyBytes(privateKeyBytes).PublicKey().String()
+		if got != want {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): key controls %s, expected %s", i, transfer.ID, got, want))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d key mismatches:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// mnemonicSeed turns a BIP39 mnemonic into its 64-byte seed. The words are
+// not checked against the wordlist, so print the derived public keys to
+// catch a typo before funds are at stake.
+func mnemonicSeed(mnemonic, passphrase string) []byte {
+	words := strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key([]byte(words), []byte("mnemonic"+passphrase), 2048, 64, sha512.New)
+}
+
+// deriveKey derives the ed25519 key at m/44'/501'/index'/0' from seed
+// following SLIP-0010, the path wallets such as Phantom and Solflare use.
+func deriveKey(seed []byte, index uint32) ed25519.PrivateKey {
+	const hardened = 0x80000000
+
+	mac := hmac.New(sha512.New, []byte("ed25519 seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	key, chainCode := sum[:32], sum[32:]
+
+	for _, segment := range []uint32{44, 501, index, 0} {
+		data := make([]byte, 0, 37)
+		data = append(data, 0)
+		data = append(data, key...)
+		data = binary.BigEndian.AppendUint32(data, segment|hardened)
+
+		mac := hmac.New(sha512.New, chainCode)
+		mac.Write(data)
+		sum := mac.Sum(nil)
+		key, chainCode = sum[:32], sum[32:]
+	}
+
+	return ed25519.NewKeyFromSeed(key)
+}
+
+// resolveDerivedKeys fills in from_private_key for every transfer that
+// names a derivation index instead, printing each new sender to out. Keys
+// it filled in before are left as they are.
+func resolveDerivedKeys(config *Config, out io.Writer) error {
+	var seed []byte
+	derived := make(map[uint32]string)
+	for i := range config.Transfers {
+		transfer := &config.Transfers[i]
+		if transfer.FromDerivationIndex == nil {
+			continue
+		}
+		if config.Mnemonic == "" {
+			return fmt.Errorf("transfer %d (id %s): from_derivation_index requires mnemonic", i, transfer.ID)
+		}
+		if seed == nil {
+			seed = mnemonicSeed(config.Mnemonic, config.MnemonicPassphrase)
+		}
+
+		index := *transfer.FromDerivationIndex
+		key, ok := derived[index]
+		if !ok {
+			privateKey := deriveKey(seed, index)
+			key = base64.StdEncoding.EncodeToString(privateKey)
+			derived[index] = key
+			if transfer.FromPrivateKey == "" {
+				printTo(out, "Derived sender %s at m/44'/501'/%d'/0'\n",
+					solana.PublicKeyFromBytes(privateKey.Public().(ed25519.PublicKey)), index)
+			}
+		}
+		switch transfer.FromPrivateKey {
+		case "":
+			transfer.FromPrivateKey = key
+		case key:
+			// Resolved before, by LoadTransfers
+		default:
+			return fmt.Errorf("transfer %d (id %s): set either from_private_key or from_derivation_index", i, transfer.ID)
+		}
+	}
+	return nil
+}
+
+// readKeypairFile reads a Solana CLI keypair file (a JSON array of the 64
+// secret key bytes) and returns the key base64 encoded like
+// from_private_key.
+func readKeypairFile(path string) (string, error) {
+	secret, err := solanakey.ReadKeypair(path)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// normalizeKeys rewrites every private key of the transfers, fee payers and
+// canary from key_format to base64, the form the rest of the program decodes,
+// and sets key_format to base64 so that normalizing again changes nothing.
+func normalizeKeys(config *Config) error {
+	normalize := func(key *string, name string) error {
+		if *key == "" {
+			return nil
+		}
+		secret, err := solanakey.Decode(*key, config.KeyFormat)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*key = base64.StdEncoding.EncodeToString(secret)
+		return nil
+	}
+
+	for i := range config.Transfers {
+		transfer := &config.Transfers[i]
+		if err := normalize(&transfer.FromPrivateKey, fmt.Sprintf("transfer %d (id %s): from_private_key", i, transfer.ID)); err != nil {
+			return err
+		}
+	}
+	for i := range config.FeePayerKeys {
+		if err := normalize(&config.FeePayerKeys[i], fmt.Sprintf("fee_payer_keys[%d]", i)); err != nil {
+			return err
+		}
+	}
+	if config.Canary != nil {
+		if err := normalize(&config.Canary.FromPrivateKey, "canary from_private_key"); err != nil {
+			return err
+		}
+	}
+	config.KeyFormat = "base64"
+	return nil
+}
+
+// ValidateTransfers checks the transfers against the configured limits
+// before anything is built, reporting every problem with the offending
+// transfer and field.
+func ValidateTransfers(config *Config) error {
+	maxMemo := config.MaxMemoBytes
+	if maxMemo <= 0 {
+		maxMemo = defaultMaxMemoBytes
+	}
+
+	if size := len(config.RunMemo); size > maxMemo {
+		return fmt.Errorf("run_memo is %d bytes, %d over the %d byte limit", size, size-maxMemo, maxMemo)
+	}
+
+	var problems []string
+	var zeroAmounts []string
+	senders := make(map[string]bool)
+	percents := make(map[string]float64)
+	for i, transfer := range config.Transfers {
+		senders[transfer.FromPrivateKey] = true
+
+		if transfer.Amount == 0 && transfer.USDAmount == 0 && transfer.Percent == 0 {
+			zeroAmounts = append(zeroAmounts, strconv.Itoa(i))
+			if config.ZeroAmount != "warn" {
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): amount is zero", i, transfer.ID))
+			}
+		}
+
+		if size := len(transfer.Memo); size > maxMemo {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): memo is %d bytes, %d over the %d byte limit",
+				i, transfer.ID, size, size-maxMemo, maxMemo))
+		}
+		if transfer.Mint != "" && transfer.USDAmount > 0 {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): usd_amount is only supported for SOL transfers", i, transfer.ID))
+		}
+		if transfer.Percent != 0 {
+			switch {
+			case transfer.Percent < 0 || transfer.Percent > 100:
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): percent must be between 0 and 100, got %v", i, transfer.ID, transfer.Percent))
+			case transfer.Amount != 0 || transfer.USDAmount != 0:
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): percent, amount and usd_amount are mutually exclusive", i, transfer.ID))
+			case transfer.Mint != "":
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): percent is only supported for SOL transfers", i, transfer.ID))
+			case transfer.SplitInto > 1:
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): split_into is not supported with percent", i, transfer.ID))
+			}
+			percents[transfer.FromPrivateKey] += transfer.Percent
+		}
+		if transfer.Commitment != "" {
+			if _, err := parseCommitment(transfer.Commitment); err != nil {
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): %v", i, transfer.ID, err))
+			}
+		}
+		switch transfer.Condition {
+		case "", "account_exists", "account_missing":
+		case "balance_below":
+			if transfer.ConditionLamports == 0 {
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): condition balance_below requires condition_lamports", i, transfer.ID))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): invalid condition %q (expected balance_below, account_exists or account_missing)", i, transfer.ID, transfer.Condition))
+		}
+		if transfer.Condition != "" && transfer.SplitInto > 1 {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): split_into is not supported with condition", i, transfer.ID))
+		}
+		if transfer.ConditionAccount != "" {
+			if _, err := solana.PublicKeyFromBase58(transfer.ConditionAccount); err != nil {
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): invalid condition_account: %v", i, transfer.ID, err))
+			}
+		}
+		if transfer.ComputeUnitLimit > maxComputeUnitLimit {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): compute_unit_limit %d is over the %d maximum", i, transfer.ID, transfer.ComputeUnitLimit, maxComputeUnitLimit))
+		}
+		if transfer.ComputeUnitPrice > math.MaxUint64/maxComputeUnitLimit {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): compute_unit_price %d is too large", i, transfer.ID, transfer.ComputeUnitPrice))
+		}
+		if transfer.DelayBeforeMs < 0 {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): delay_before_ms must not be negative, got %d", i, transfer.ID, transfer.DelayBeforeMs))
+		}
+		if transfer.SplitInto > 1 {
+			switch {
+			case transfer.USDAmount > 0:
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): split_into is not supported with usd_amount", i, transfer.ID))
+			case transfer.NonceAccount != "":
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): split_into is not supported with nonce_account", i, transfer.ID))
+			case uint64(transfer.SplitInto) > transfer.Amount:
+				problems = append(problems, fmt.Sprintf("transfer %d (id %s): cannot split %d into %d parts", i, transfer.ID, transfer.Amount, transfer.SplitInto))
+			}
+		}
+		if transfer.TokenAccount != "" && transfer.Mint == "" {
+			problems = append(problems, fmt.Sprintf("transfer %d (id %s): token_account requires mint", i, transfer.ID))
+		}
+	}
+
+	// Percentages apply to what is left after fixed amounts and fees
+	var overcommitted int
+	for _, total := range percents {
+		if total > 100 {
+			overcommitted++
+		}
+	}
+	if overcommitted > 0 {
+		problems = append(problems, fmt.Sprintf("%d senders have percent transfers adding up to more than 100%%", overcommitted))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d invalid transfers:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	if len(zeroAmounts) > 0 {
+		log.Printf("Warning: %d transfers have a zero amount and will only pay fees (indices %s)",
+			len(zeroAmounts), strings.Join(zeroAmounts, ","))
+	}
+
+	if config.MaxSenders > 0 && len(senders) > config.MaxSenders {
+		return fmt.Errorf("transfers use %d distinct senders, more than max_senders %d", len(senders), config.MaxSenders)
+	}
+	return nil
+}
+
+// splitTransfers replaces every transfer with split_into > 1 by its parts.
+// The first amount % N parts carry one extra unit so the parts sum exactly
+// to the original amount. It also returns the part IDs of each split ID.
+func splitTransfers(transfers []TransferInstruction) ([]TransferInstruction, map[string][]string) {
+	var expanded []TransferInstruction
+	parts := make(map[string][]string)
+	for _, transfer := range transfers {
+		if transfer.SplitInto <= 1 {
+			expanded = append(expanded, transfer)
+			continue
+		}
+
+		n := uint64(transfer.SplitInto)
+		for i := uint64(0); i < n; i++ {
+			part := transfer
+			part.ID = fmt.Sprintf("%s/%d", transfer.ID, i+1)
+			part.Amount = transfer.Amount / n
+			if i < transfer.Amount%n {
+				part.Amount++
+			}
+			part.SplitInto = 0
+			part.uniqueMemo = true
+			expanded = append(expanded, part)
+			parts[transfer.ID] = append(parts[transfer.ID], part.ID)
+		}
+	}
+	return expanded, parts
+}
+
+// printSplitSummary prints, per split transfer, how many of its parts were
+// confirmed and how much of the amount they moved.
+func printSplitSummary(parts map[string][]string, results []TransferResult) {
+	byID := make(map[string]TransferResult, len(results))
+	for _, result := range results {
+		byID[result.ID] = result
+	}
+
+	ids := make([]string, 0, len(parts))
+	for id := range parts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Println("Split Transfers:")
+	for _, id := range ids {
+		var confirmed int
+		var sent, total uint64
+		for _, partID := range parts[id] {
+			result, ok := byID[partID]
+			if !ok {
+				continue
+			}
+			total += result.Amount
+			if result.Status == "Confirmed" {
+				confirmed++
+				sent += result.Amount
+			}
+		}
+		fmt.Printf("   %s: %d of %d parts confirmed (%d of %d)\n", id, confirmed, len(parts[id]), sent, total)
+	}
+}
+
+// signatureFee is the base fee per signature, in lamports.
+const signatureFee = 5000
+
+// transactionFeeReserve is the fee set aside per transaction when resolving
+// percent amounts: the signature fee plus the priority fee at the configured
+// unit price and limit (the 200,000 unit default when no limit is set).
+func transactionFeeReserve(config *Config) uint64 {
+	return budgetFeeReserve(config.ComputeUnitPrice, config.ComputeUnitLimit)
+}
+
+// transferFeeReserve is transactionFeeReserve for transfer's own compute
+// budget.
+func transferFeeReserve(config *Config, transfer *TransferInstruction) uint64 {
+	price, limit := transferBudget(config, transfer)
+	return budgetFeeReserve(price, limit)
+}
+
+func budgetFeeReserve(price uint64, limit uint32) uint64 {
+	units := uint64(limit)
+	if units == 0 {
+		units = 200_000
+	}
+	return signatureFee + (price*units+999_999)/1_000_000
+}
+
+// transferBudget returns the compute unit price and limit for transfer, its
+// own values taking precedence over the config's.
+func transferBudget(config *Config, transfer *TransferInstruction) (uint64, uint32) {
+	price, limit := config.ComputeUnitPrice, config.ComputeUnitLimit
+	if transfer.ComputeUnitPrice > 0 {
+		price = transfer.ComputeUnitPrice
+	}
+	if transfer.ComputeUnitLimit > 0 {
+		limit = transfer.ComputeUnitLimit
+	}
+	return price, limit
+}
+
+// percentPlan is what resolvePercentAmounts needs before reading balances.
+type percentPlan struct {
+	// Sender of each transfer, by index
+	senders []solana.PublicKey
+	// Senders with at least one percent transfer, in first-use order
+	percentSenders []solana.PublicKey
+	// Fixed SOL amounts and fee reserves per sender
+	committed map[solana.PublicKey]uint64
+}
+
+// planPercentAmounts works out each transfer's sender, which senders need
+// their balance read, and what their other transfers commit.
+func planPercentAmounts(config *Config, transfers []TransferInstruction) (*percentPlan, error) {
+	plan := &percentPlan{
+		senders:   make([]solana.PublicKey, len(transfers)),
+		committed: make(map[solana.PublicKey]uint64),
+	}
+	seen := make(map[solana.PublicKey]bool)
+	for i, transfer := range transfers {
+		privateKeyBytes, err := base64.StdEncoding.DecodeString(transfer.FromPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("transfer %s: failed to decode private key: %w", transfer.ID, err)
+		}
+		sender := solana.NewAccountFromPrivateKeyBytes(privateKeyBytes).PublicKey()
+		plan.senders[i] = sender
+
+		if transfer.Percent > 0 && !seen[sender] {
+			seen[sender] = true
+			plan.percentSenders = append(plan.percentSenders, sender)
+		}
+		plan.committed[sender] += transferFeeReserve(config, &transfer)
+		if transfer.Mint == "" && transfer.Percent == 0 {
+			plan.committed[sender] += transfer.Amount
+		}
+	}
+	return plan, nil
+}
+
+// resolvePercentAmounts turns percent transfers into fixed amounts from each
+// sender's balance, read once so concurrent transfers do not shift the base.
+// The base is the balance less the sender's fixed SOL amounts and a fee
+// reserve for each of its transactions.
+func (r *transferRunner) resolvePercentAmounts(ctx context.Context, transfers []TransferInstruction) error {
+	plan, err := planPercentAmounts(r.config, transfers)
+	if err != nil {
+		return err
+	}
+	if len(plan.percentSenders) == 0 {
+		return nil
+	}
+	senders, committed := plan.senders, plan.committed
+
+	bases := make(map[solana.PublicKey]uint64, len(plan.percentSenders))
+	for _, sender := range plan.percentSenders {
+		balance, err := r.client.GetBalance(ctx, sender, r.readCommitment())
+		if err != nil {
+			return fmt.Errorf("failed to get balance of %s: %w", sender, err)
+		}
+		if balance.Value <= committed[sender] {
+			return fmt.Errorf("sender %s has %d lamports, not more than the %d its fixed amounts and fees need",
+				sender, balance.Value, committed[sender])
+		}
+		bases[sender] = balance.Value - committed[sender]
+	}
+
+	for i := range transfers {
+		if transfers[i].Percent == 0 {
+			continue
+		}
+		base := bases[senders[i]]
+		amount := uint64(math.Floor(float64(base) * transfers[i].Percent / 100))
+		if amount == 0 {
+			return fmt.Errorf("transfer %s: %v%% of %d lamports is 0 lamports", transfers[i].ID, transfers[i].Percent, base)
+		}
+		log.Printf("Resolved %v%% of %d lamports to %d lamports for %s", transfers[i].Percent, base, amount, transfers[i].ID)
+		transfers[i].Amount = amount
+		transfers[i].Percent = 0
+	}
+	return nil
+}
+
+// shuffleTransfers returns a copy of transfers in a random order determined
+// by seed.
+func shuffleTransfers(transfers []TransferInstruction, seed int64) []TransferInstruction {
+	shuffled := append([]TransferInstruction(nil), transfers...)
+	mathrand.New(mathrand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// printAssetTotals prints confirmed counts and amounts per asset, native
+// SOL in lamports and every mint in its base units, since amounts of
+// different assets cannot be added up. It prints nothing for SOL-only runs.
+func printAssetTotals(results []TransferResult) {
+	type totals struct {
+		transfers, confirmed int
+		amount, sent         uint64
+	}
+	byAsset := make(map[string]*totals)
+	var mints []string
+	for _, result := range results {
+		t := byAsset[result.Mint]
+		if t == nil {
+			t = &totals{}
+			byAsset[result.Mint] = t
+			if result.Mint != "" {
+				mints = append(mints, result.Mint)
+			}
+		}
+		t.transfers++
+		t.amount += result.Amount
+		if result.Status == "Confirmed" {
+			t.confirmed++
+			t.sent += result.Amount
+		}
+	}
+	if len(mints) == 0 {
+		return
+	}
+	sort.Strings(mints)
+
+	fmt.Println("Totals Per Asset:")
+	if t := byAsset[""]; t != nil {
+		fmt.Printf("   SOL: %d of %d confirmed (%d of %d lamports)\n", t.confirmed, t.transfers, t.sent, t.amount)
+	}
+	for _, mint := range mints {
+		t := byAsset[mint]
+		fmt.Printf("   %s: %d of %d confirmed (%d of %d base units)\n", mint, t.confirmed, t.transfers, t.sent, t.amount)
+	}
+}
+
+// ParseIndices parses a comma-separated list of transfer indices, rejecting
+// duplicates.
+func ParseIndices(list string) ([]int, error) {
+	var indices []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %q", part)
+		}
+		if seen[i] {
+			return nil, fmt.Errorf("duplicate index %d", i)
+		}
+		seen[i] = true
+		indices = append(indices, i)
+	}
+	if len(indices) == 0 {
+		return nil, fmt.Errorf("no indices given")
+	}
+	return indices, nil
+}
+
+// SelectTransfers returns the transfers at the given indices, in the order
+// given, failing if any index is out of range.
+func SelectTransfers(transfers []TransferInstruction, indices []int) ([]TransferInstruction, error) {
+	selected := make([]TransferInstruction, 0, len(indices))
+	for _, i := range indices {
+		if i < 0 || i >= len(transfers) {
+			return nil, fmt.Errorf("index %d out of range, %d transfers configured", i, len(transfers))
+		}
+		selected = append(selected, transfers[i])
+	}
+	return selected, nil
+}
+
+// Endpoints returns rpc_url followed by any distinct rpc_urls.
+func (c *Config) Endpoints() []string {
+	endpoints := []string{c.RpcURL}
+	seen := map[string]bool{c.RpcURL: true}
+	for _, endpoint := range c.RpcURLs {
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// CanaryConfig is a pre-flight transfer that exercises keys, fees, RPC and
+// confirmation before the batch. It is sent from from_private_key, by
+// default the first transfer's sender, and must succeed within
+// timeout_seconds (default 60).
+type CanaryConfig struct {
+	FromPrivateKey string `mapstructure:"from_private_key"`
+	ToAddress      string `mapstructure:"to_address"`
+	Amount         uint64 `mapstructure:"amount"`
+	TimeoutSeconds int    `mapstructure:"timeout_seconds"`
+}
+
+// EndpointLimit caps the concurrent requests to the endpoint at URL.
+type EndpointLimit struct {
+	URL           string `mapstructure:"url"`
+	MaxConcurrent int    `mapstructure:"max_concurrent"`
+}
+
+// parseCommitment validates a commitment level from the config.
+func parseCommitment(value string) (rpc.CommitmentType, error) {
+	switch commitment := rpc.CommitmentType(value); commitment {
+	case rpc.CommitmentProcessed, rpc.CommitmentConfirmed, rpc.CommitmentFinalized:
+		return commitment, nil
+	default:
+		return "", fmt.Errorf("invalid commitment %q (expected processed, confirmed or finalized)", value)
+	}
+}
+
+// commitmentRank orders commitment levels from weakest to strongest.
+var commitmentRank = map[string]int{
+	string(rpc.CommitmentProcessed): 0,
+	string(rpc.CommitmentConfirmed): 1,
+	string(rpc.CommitmentFinalized): 2,
+}
+
+// successPolicy is when a transaction counts as confirmed: commitment
+// reached and, until it is finalized, at least minConfirmations blocks on
+// top of it. Every confirmation path goes through it.
+type successPolicy struct {
+	commitment       rpc.CommitmentType
+	minConfirmations uint64
+}
+
+func newSuccessPolicy(config *Config, commitment rpc.CommitmentType) successPolicy {
+	return successPolicy{commitment: commitment, minConfirmations: config.MinConfirmations}
+}
+
+// reached reports whether status satisfies the policy. Finalized (rooted)
+// transactions satisfy any confirmation count.
+func (p successPolicy) reached(status *rpc.SignatureStatusesResult) bool {
+	if !commitmentReached(status, p.commitment) {
+		return false
+	}
+	if p.minConfirmations == 0 || status.Confirmations == nil || status.ConfirmationStatus == rpc.ConfirmationStatusFinalized {
+		return true
+	}
+	return *status.Confirmations >= p.minConfirmations
+}
+
+// commitmentReached reports whether a signature status satisfies target.
+func commitmentReached(status *rpc.SignatureStatusesResult, target rpc.CommitmentType) bool {
+	reached := string(status.ConfirmationStatus)
+	// Nodes that omit confirmationStatus report rooted transactions with
+	// nil confirmations
+	if reached == "" {
+		reached = string(rpc.CommitmentProcessed)
+		if status.Confirmations == nil {
+			reached = string(rpc.CommitmentFinalized)
+		}
+	}
+	return commitmentRank[reached] >= commitmentRank[string(target)]
+}
+
+// stateRecord is one line of the state file. Each record carries the full
+// context of the transfer so the file can be reconciled on its own.
+type stateRecord struct {
+	RunID     string    `json:"run_id"`
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Endpoint  string    `json:"endpoint"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Amount    uint64    `json:"amount"`
+	Comment   string    `json:"comment,omitempty"`
+	Signature string    `json:"signature,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	// Last block height at which the signature's transaction can land;
+	// zero for durable nonce transactions, which do not expire
+	LastValidBlockHeight uint64 `json:"last_valid_block_height,omitempty"`
+}
+
+// stateFile appends stateRecords to a JSON lines file. Records are never
+// rewritten; the latest record for an ID wins when the file is loaded.
+type stateFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openStateFile(path string) (*stateFile, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+	return &stateFile{file: file}, nil
+}
+
+func (s *stateFile) Append(record stateRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode state record: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write state record: %w", err)
+	}
+	return s.file.Sync()
+}
+
+func (s *stateFile) Close() error {
+	return s.file.Close()
+}
+
+// loadState reads a state file and returns the latest record per transfer ID.
+// A missing file is not an error: it simply means nothing has run yet.
+func loadState(path string) (map[string]stateRecord, error) {
+	records := make(map[string]stateRecord)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record stateRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid state record on line %d: %w", line, err)
+		}
+		records[record.ID] = record
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	return records, nil
+}
+
+// shouldSkip reports whether a transfer must not be sent again given its
+// latest state record, along with a short reason and a detailed message.
+// Submitted transfers are skipped too: their outcome is unknown and resending
+// could pay twice.
+func shouldSkip(record stateRecord, ok bool) (bool, string, string) {
+	if !ok {
+		return false, "", ""
+	}
+	switch record.Status {
+	case "Confirmed", "Finalized":
+		return true, "already confirmed",
+			fmt.Sprintf("already confirmed in run %s (%s)", record.RunID, record.Signature)
+	case "Submitted":
+		return true, "submitted with unknown outcome",
+			fmt.Sprintf("submitted in run %s with unknown outcome (%s), reconcile manually", record.RunID, record.Signature)
+	default:
+		return false, "", ""
+	}
+}
+
+// transferNonce returns a memo that is unique per transfer attempt.
+func transferNonce(runID, transferID string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%s:%s:%d", runID, transferID, time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%s:%s:%s", runID, transferID, hex.EncodeToString(b))
+}
+
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102T150405Z")
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// priceOracle fetches the SOL price in USD from an HTTP endpoint and caches
+// it for up to maxAge, so a run does not query the endpoint per transfer.
+type priceOracle struct {
+	url           string
+	jsonPath      string
+	timestampPath string
+	maxAge        time.Duration
+	httpClient    *http.Client
+
+	mu        sync.Mutex
+	price     float64
+	fetchedAt time.Time
+}
+
+func newPriceOracle(config *Config) *priceOracle {
+	maxAge := time.Duration(config.PriceMaxAgeSeconds) * time.Second
+	if maxAge <= 0 {
+		maxAge = 60 * time.Second
+	}
+
+	jsonPath := config.PriceJSONPath
+	if jsonPath == "" {
+		jsonPath = "solana.usd"
+	}
+
+	return &priceOracle{
+		url:           config.PriceSourceURL,
+		jsonPath:      jsonPath,
+		timestampPath: config.PriceTimestampPath,
+		maxAge:        maxAge,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Price returns the current USD price of one SOL, refetching it when the
+// cached value is older than maxAge.
+func (o *priceOracle) Price(ctx context.Context) (float64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.price > 0 && time.Since(o.fetchedAt) < o.maxAge {
+		return o.price, nil
+	}
+
+	price, publishedAt, err := o.fetch(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Reject prices the source itself reports as old
+	if age := time.Since(publishedAt); age > o.maxAge {
+		return 0, fmt.Errorf("price from %s is stale: published %v ago (max age %v)", o.url, age.Round(time.Second), o.maxAge)
+	}
+
+	o.price = price
+	o.fetchedAt = time.Now()
+	return price, nil
+}
+
+func (o *priceOracle) fetch(ctx context.Context) (float64, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.url, nil)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to create price request: %w", err)
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to fetch price: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, fmt.Errorf("price source returned HTTP %d", resp.StatusCode)
+	}
+
+	var body interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to decode price response: %w", err)
+	}
+
+	price, err := jsonNumberAt(body, o.jsonPath)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to read price: %w", err)
+	}
+	if price <= 0 || math.IsNaN(price) || math.IsInf(price, 0) {
+		return 0, time.Time{}, fmt.Errorf("invalid price %v", price)
+	}
+
+	// Without a timestamp in the response the fetch time is the best we have
+	publishedAt := time.Now()
+	if o.timestampPath != "" {
+		ts, err := jsonNumberAt(body, o.timestampPath)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("failed to read price timestamp: %w", err)
+		}
+		// Accept both seconds and milliseconds since epoch
+		if ts > 1e12 {
+			publishedAt = time.UnixMilli(int64(ts))
+		} else {
+			publishedAt = time.Unix(int64(ts), 0)
+		}
+	}
+
+	return price, publishedAt, nil
+}
+
+// jsonNumberAt walks a dot-separated path (e.g. "solana.usd" or "data.0.price")
+// through decoded JSON and returns the number found there. Numeric strings are
+// accepted since many price APIs quote prices as strings.
+func jsonNumberAt(value interface{}, path string) (float64, error) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return 0, fmt.Errorf("key %q not found in path %q", key, path)
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return 0, fmt.Errorf("invalid index %q in path %q", key, path)
+			}
+			value = node[i]
+		default:
+			return 0, fmt.Errorf("cannot descend into %q in path %q", key, path)
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("value at %q is not a number", path)
+	}
+}
+
+// resolveAmount returns the lamport amount of a transfer, converting
+// usd_amount at the oracle's current rate when set.
+func resolveAmount(ctx context.Context, transfer TransferInstruction, oracle *priceOracle) (uint64, float64, error) {
+	if transfer.USDAmount == 0 {
+		return transfer.Amount, 0, nil
+	}
+	if transfer.Amount != 0 {
+		return 0, 0, fmt.Errorf("amount and usd_amount are mutually exclusive")
+	}
+	if transfer.USDAmount < 0 {
+		return 0, 0, fmt.Errorf("usd_amount must be positive, got %v", transfer.USDAmount)
+	}
+	if oracle == nil || oracle.url == "" {
+		return 0, 0, fmt.Errorf("usd_amount requires price_source_url to be configured")
+	}
+
+	rate, err := oracle.Price(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	lamports := uint64(math.Round(transfer.USDAmount / rate * float64(solana.LAMPORTS_PER_SOL)))
+	if lamports == 0 {
+		return 0, 0, fmt.Errorf("usd_amount $%.2f converts to 0 lamports at %.4f USD/SOL", transfer.USDAmount, rate)
+	}
+
+	return lamports, rate, nil
+}
+
+// rateLimiter spaces requests evenly so that no more than rate requests per
+// second are issued.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+
+	// AIMD state, used only when adaptive. what names the rate in logs;
+	// cooldown is the minimum time between decreases.
+	adaptive       bool
+	what           string
+	cooldown       time.Duration
+	rate, peak     float64
+	min, max, step float64
+	lastIncrease   time.Time
+	lastDecrease   time.Time
+	decreases      int
+
+	// Total time callers spent waiting, in nanoseconds
+	waited atomic.Int64
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate), rate: rate}
+}
+
+// newAdaptiveRateLimiter returns a rateLimiter starting at rate that
+// Succeeded and Throttled move between min and max.
+func newAdaptiveRateLimiter(rate, min, max, step float64) *rateLimiter {
+	l := newRateLimiter(rate)
+	l.adaptive = true
+	l.what = "request rate"
+	l.cooldown = time.Second
+	l.min, l.max, l.step = min, max, step
+	l.peak = rate
+	l.lastIncrease = time.Now()
+	return l
+}
+
+// setRate changes the rate; l.mu must be held.
+func (l *rateLimiter) setRate(rate float64) {
+	l.rate = rate
+	l.interval = time.Duration(float64(time.Second) / rate)
+}
+
+// Succeeded adds step to the rate for every second of requests without a
+// 429, up to max.
+func (l *rateLimiter) Succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.adaptive || time.Since(l.lastIncrease) < time.Second || l.rate >= l.max {
+		return
+	}
+	l.setRate(math.Min(l.rate+l.step, l.max))
+	l.lastIncrease = time.Now()
+	if l.rate > l.peak {
+		l.peak = l.rate
+	}
+}
+
+// Throttled halves the rate, down to min, because of reason. Signals within
+// the cooldown, such as the 429s of requests already in flight at the old
+// rate, count as one.
+func (l *rateLimiter) Throttled(reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.adaptive || time.Since(l.lastDecrease) < l.cooldown {
+		return
+	}
+	l.setRate(math.Max(l.rate/2, l.min))
+	l.lastDecrease = time.Now()
+	l.lastIncrease = l.lastDecrease
+	l.decreases++
+	log.Printf("%s, lowering %s to %.1f/s", reason, l.what, l.rate)
+}
+
+// printStats reports where an adaptive rate ended up.
+func (l *rateLimiter) printStats() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.adaptive {
+		fmt.Printf("Adaptive %s: %.1f/s at the end (peak %.1f, %d backoffs)\n", l.what, l.rate, l.peak, l.decreases)
+	}
+}
+
+// Wait blocks until the caller may issue its next request.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { l.waited.Add(int64(time.Since(start))) }()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedTransport applies a rateLimiter to every HTTP request, which
+// covers all RPC calls made through the client without touching call sites.
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// feePayerPool hands out the fee_payer_keys accounts, one per transaction,
+// so no single payer becomes a bottleneck or runs dry. Balances are read
+// once and then decreased by each transaction's estimated fee.
+type feePayerPool struct {
+	byBalance bool
+	fee       uint64
+	// read_commitment, for every balance read
+	commitment rpc.CommitmentType
+
+	mu     sync.Mutex
+	payers []*pooledPayer
+	next   int
+}
+
+type pooledPayer struct {
+	account      *solana.Account
+	startBalance uint64
+	balance      uint64
+	transactions int
+}
+
+func newFeePayerPool(ctx context.Context, client *rpc.Client, config *Config) (*feePayerPool, error) {
+	pool := &feePayerPool{
+		byBalance:  config.FeePayerSelection == "balance",
+		fee:        transactionFeeReserve(config) + signatureFee,
+		commitment: rpc.CommitmentType(config.ReadCommitment),
+	}
+	for i, key := range config.FeePayerKeys {
+		privateKeyBytes, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("fee_payer_keys[%d]: failed to decode private key: %w", i, err)
+		}
+		account := solana.NewAccountFromPrivateKeyBytes(privateKeyBytes)
+		balance, err := client.GetBalance(ctx, account.PublicKey(), pool.commitment)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get balance of fee payer %s: %w", account.PublicKey(), err)
+		}
+		pool.payers = append(pool.payers, &pooledPayer{account: account, startBalance: balance.Value, balance: balance.Value})
+	}
+	return pool, nil
+}
+
+// Next returns the payer for the next transaction: the following one in
+// turn, or the one with the most lamports left when selecting by balance.
+func (p *feePayerPool) Next() *solana.Account {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payer := p.payers[p.next]
+	if p.byBalance {
+		for _, candidate := range p.payers {
+			if candidate.balance > payer.balance {
+				payer = candidate
+			}
+		}
+	} else {
+		p.next = (p.next + 1) % len(p.payers)
+	}
+
+	payer.transactions++
+	if payer.balance > p.fee {
+		payer.balance -= p.fee
+	} else {
+		payer.balance = 0
+	}
+	return payer.account
+}
+
+// printStats prints each payer's transactions and remaining balance, read
+// again so it reflects the fees actually charged.
+func (p *feePayerPool) printStats(ctx context.Context, client *rpc.Client) {
+	fmt.Println("\nFee Payers:")
+	fmt.Println("===========")
+	for _, payer := range p.payers {
+		remaining := fmt.Sprintf("~%d lamports (estimated)", payer.balance)
+		if balance, err := client.GetBalance(ctx, payer.account.PublicKey(), p.commitment); err == nil {
+			remaining = fmt.Sprintf("%d lamports", balance.Value)
+		}
+		fmt.Printf("%s\n   Transactions: %d\n   Balance: %d lamports at start, %s now\n",
+			payer.account.PublicKey(), payer.transactions, payer.startBalance, remaining)
+	}
+}
+
+// latencyThrottle adapts a send rateLimiter to the rolling average of
+// recent confirmation latencies, slowing sends when the cluster is slow to
+// confirm so unconfirmed transactions do not pile up.
+type latencyThrottle struct {
+	limiter   *rateLimiter
+	threshold time.Duration
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyThrottle(config *Config) *latencyThrottle {
+	window := config.LatencyWindow
+	if window <= 0 {
+		window = 20
+	}
+	rate := config.LatencySendRate
+	if rate <= 0 {
+		rate = 10
+	}
+	min := config.LatencySendRateMin
+	if min <= 0 {
+		min = 1
+	}
+	threshold := time.Duration(config.LatencyThresholdMs) * time.Millisecond
+
+	limiter := newAdaptiveRateLimiter(rate, min, 10*rate, 1)
+	limiter.what = "send rate"
+	// The average lags, so give a decrease time to show in it
+	limiter.cooldown = threshold
+	return &latencyThrottle{limiter: limiter, threshold: threshold, samples: make([]time.Duration, window)}
+}
+
+// Observe records a confirmation latency and adjusts the send rate once the
+// window has filled.
+func (t *latencyThrottle) Observe(latency time.Duration) {
+	t.mu.Lock()
+	t.samples[t.next] = latency
+	t.next = (t.next + 1) % len(t.samples)
+	if t.next == 0 {
+		t.full = true
+	}
+	if !t.full {
+		t.mu.Unlock()
+		return
+	}
+	var total time.Duration
+	for _, sample := range t.samples {
+		total += sample
+	}
+	average := total / time.Duration(len(t.samples))
+	t.mu.Unlock()
+
+	switch {
+	case average > t.threshold:
+		t.limiter.Throttled(fmt.Sprintf("Average confirmation latency %v above %v", average.Round(time.Millisecond), t.threshold))
+	case average < t.threshold/2:
+		t.limiter.Succeeded()
+	}
+}
+
+// throttleTransport reports every attempt's outcome to an adaptive
+// rateLimiter. It sits below failover so a 429 is seen even when another
+// endpoint then answers the request.
+type throttleTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	switch {
+	case err != nil:
+	case resp.StatusCode == http.StatusTooManyRequests:
+		t.limiter.Throttled("Rate limited (429)")
+	case resp.StatusCode < 400:
+		t.limiter.Succeeded()
+	}
+	return resp, err
+}
+
+// debugTransport logs the body of every request and response passing
+// through it. It sits below failover so each attempt shows its endpoint.
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := redactURL(req.URL)
+
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		log.Printf("RPC request to %s: %s", endpoint, body)
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		log.Printf("RPC error from %s after %v: %v", endpoint, time.Since(start), err)
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	log.Printf("RPC response from %s (%s, %v): %s", endpoint, resp.Status, time.Since(start), body)
+	return resp, nil
+}
+
+// redactURL renders u without the credentials providers embed in endpoint
+// URLs: user info, query values and key-like path segments.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	if redacted.User != nil {
+		redacted.User = url.User("REDACTED")
+	}
+
+	query := redacted.Query()
+	for key := range query {
+		query.Set(key, "REDACTED")
+	}
+	redacted.RawQuery = query.Encode()
+
+	segments := strings.Split(redacted.Path, "/")
+	for i, segment := range segments {
+		if len(segment) >= 20 {
+			segments[i] = "REDACTED"
+		}
+	}
+	redacted.Path = strings.Join(segments, "/")
+	redacted.RawPath = ""
+
+	return redacted.String()
+}
+
+// endpointStats counts the requests sent to one endpoint and its errors by
+// category.
+type endpointStats struct {
+	url *url.URL
+	// Request slots if the endpoint has a concurrency cap, nil otherwise
+	slots chan struct{}
+
+	mu        sync.Mutex
+	requests  int
+	errors    map[string]int
+	saturated int
+}
+
+// tryAcquire takes a request slot if one is free, counting the misses.
+func (e *endpointStats) tryAcquire() bool {
+	if e.slots == nil {
+		return true
+	}
+	select {
+	case e.slots <- struct{}{}:
+		return true
+	default:
+		e.mu.Lock()
+		e.saturated++
+		e.mu.Unlock()
+		return false
+	}
+}
+
+// acquire waits for a request slot.
+func (e *endpointStats) acquire(ctx context.Context) error {
+	if e.slots == nil {
+		return nil
+	}
+	select {
+	case e.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *endpointStats) release() {
+	if e.slots != nil {
+		<-e.slots
+	}
+}
+
+// releasingBody frees an endpoint's request slot once the response body is
+// closed, so reading the response counts against the cap too.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func (e *endpointStats) record(category string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.requests++
+	if category != "" {
+		e.errors[category]++
+	}
+}
+
+// failoverTransport sends each request to the currently preferred endpoint
+// and moves on to the next one when it fails, so one unhealthy provider does
+// not fail the whole run.
+type failoverTransport struct {
+	base      http.RoundTripper
+	endpoints []*endpointStats
+
+	mu     sync.Mutex
+	active int
+}
+
+func newFailoverTransport(endpoints []string, limits []EndpointLimit, base http.RoundTripper) (*failoverTransport, error) {
+	caps := make(map[string]int)
+	for _, limit := range limits {
+		if limit.MaxConcurrent <= 0 {
+			return nil, fmt.Errorf("endpoint_limits: max_concurrent for %s must be positive", redactEndpoint(limit.URL))
+		}
+		caps[limit.URL] = limit.MaxConcurrent
+	}
+
+	t := &failoverTransport{base: base}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RPC endpoint %q: %w", endpoint, err)
+		}
+		stats := &endpointStats{url: u, errors: make(map[string]int)}
+		if limit, ok := caps[endpoint]; ok {
+			stats.slots = make(chan struct{}, limit)
+			delete(caps, endpoint)
+		}
+		t.endpoints = append(t.endpoints, stats)
+	}
+	if len(caps) > 0 {
+		unknown := make([]string, 0, len(caps))
+		for endpoint := range caps {
+			unknown = append(unknown, redactEndpoint(endpoint))
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("endpoint_limits: not rpc_url or one of rpc_urls: %s", strings.Join(unknown, ", "))
+	}
+	return t, nil
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body has to be replayable to retry it against another endpoint
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.mu.Lock()
+	start := t.active
+	t.mu.Unlock()
+
+	order := make([]int, len(t.endpoints))
+	for i := range order {
+		order[i] = (start + i) % len(t.endpoints)
+	}
+
+	var lastErr error
+	for len(order) > 0 {
+		// Take the first endpoint in order below its concurrency cap, or
+		// wait for the first one if all of them are at it
+		pick := -1
+		for i, index := range order {
+			if t.endpoints[index].tryAcquire() {
+				pick = i
+				break
+			}
+		}
+		if pick < 0 {
+			pick = 0
+			if err := t.endpoints[order[0]].acquire(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+		index := order[pick]
+		order = append(order[:pick], order[pick+1:]...)
+		endpoint := t.endpoints[index]
+
+		attempt := req.Clone(req.Context())
+		attempt.URL = endpoint.url
+		attempt.Host = endpoint.url.Host
+		attempt.Body = io.NopCloser(bytes.NewReader(body))
+		attempt.ContentLength = int64(len(body))
+
+		resp, err := t.base.RoundTrip(attempt)
+		category := classifyEndpointError(resp, err)
+		endpoint.record(category)
+		if category == "" {
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: endpoint.release}
+			return resp, nil
+		}
+
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("%s returned HTTP %d", endpoint.url.Host, resp.StatusCode)
+			resp.Body.Close()
+		}
+		endpoint.release()
+
+		// Cancellation is not the endpoint's fault, don't fail over
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+
+		t.mu.Lock()
+		if t.active == index {
+			t.active = (index + 1) % len(t.endpoints)
+		}
+		t.mu.Unlock()
+	}
+
+	return nil, fmt.Errorf("all %d RPC endpoints failed, last error: %w", len(t.endpoints), lastErr)
+}
+
+// classifyEndpointError returns the error category of an HTTP round trip, or
+// "" if it succeeded.
+func classifyEndpointError(resp *http.Response, err error) string {
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "rate limited (429)"
+	case resp.StatusCode >= 500:
+		return "server error (5xx)"
+	case resp.StatusCode >= 400:
+		return "client error (4xx)"
+	default:
+		return ""
+	}
+}
+
+// printEndpointStats prints a per-endpoint request and error table.
+func (t *failoverTransport) printEndpointStats() {
+	fmt.Println("\nEndpoint Statistics:")
+	fmt.Println("====================")
+	for _, endpoint := range t.endpoints {
+		endpoint.mu.Lock()
+		errorCount := 0
+		for _, n := range endpoint.errors {
+			errorCount += n
+		}
+		fmt.Printf("%s\n   Requests: %d\n   Errors: %d", endpoint.url.Host, endpoint.requests, errorCount)
+		if errorCount > 0 {
+			fmt.Printf(" (%s)", formatCounts(endpoint.errors))
+		}
+		fmt.Println()
+		if endpoint.slots != nil {
+			fmt.Printf("   Concurrency Cap: %d (at cap %d times)\n", cap(endpoint.slots), endpoint.saturated)
+		}
+		endpoint.mu.Unlock()
+	}
+}
+
+// Defaults matching the HTTP transport rpc.New builds.
+const (
+	defaultMaxConnsPerHost = 9
+	defaultIdleConnTimeout = 5 * time.Minute
+	defaultKeepAlive       = 180 * time.Second
+)
+
+// newHTTPTransport builds the transport for RPC calls. It starts from the
+// same settings rpc.New uses, whose limit of 9 connections per host caps
+// throughput at high concurrency, and applies the configured pool sizes.
+func newHTTPTransport(config *Config) *http.Transport {
+	maxConnsPerHost := defaultMaxConnsPerHost
+	if config.MaxConnsPerHost > 0 {
+		maxConnsPerHost = config.MaxConnsPerHost
+	}
+	maxIdleConnsPerHost := maxConnsPerHost
+	if config.MaxIdleConnsPerHost > 0 {
+		maxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	keepAlive := defaultKeepAlive
+	if config.KeepAliveSeconds > 0 {
+		keepAlive = time.Duration(config.KeepAliveSeconds) * time.Second
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     defaultIdleConnTimeout,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		MaxConnsPerHost:     maxConnsPerHost,
+		DisableKeepAlives:   config.KeepAliveSeconds < 0,
+	}
+}
+
+// Endpoints holds what NewRPCClient layers under a client that a run's
+// statistics report on.
+type Endpoints struct {
+	// Nil with one endpoint
+	failover *failoverTransport
+	// Nil without rate_limit
+	limiter *rateLimiter
+}
+
+// NewRPCClient creates the RPC client, layering failover across multiple
+// endpoints and the rate limit onto its HTTP transport when configured. The
+// Endpoints are for Options, so that Report covers them.
+func NewRPCClient(config *Config) (*rpc.Client, *Endpoints, error) {
+	var transport http.RoundTripper = newHTTPTransport(config)
+	if config.DebugRPC {
+		transport = &debugTransport{base: transport}
+	}
+
+	var limiter *rateLimiter
+	switch {
+	case config.AdaptiveRate:
+		rate := config.RateLimit
+		if rate <= 0 {
+			rate = 10
+		}
+		min, max, step := config.AdaptiveRateMin, config.AdaptiveRateMax, config.AdaptiveRateStep
+		if min <= 0 {
+			min = 1
+		}
+		if max <= 0 {
+			max = 10 * rate
+		}
+		if step <= 0 {
+			step = 1
+		}
+		limiter = newAdaptiveRateLimiter(rate, min, max, step)
+		transport = &throttleTransport{base: transport, limiter: limiter}
+	case config.RateLimit > 0:
+		limiter = newRateLimiter(config.RateLimit)
+	}
+
+	var failover *failoverTransport
+	if endpoints := config.Endpoints(); len(endpoints) > 1 || len(config.EndpointLimits) > 0 {
+		var err error
+		failover, err = newFailoverTransport(endpoints, config.EndpointLimits, transport)
+		if err != nil {
+			return nil, nil, err
+		}
+		transport = failover
+	}
+
+	if limiter != nil {
+		transport = &rateLimitedTransport{
+			base:    transport,
+			limiter: limiter,
+		}
+	}
+
+	httpClient := &http.Client{Transport: transport}
+
+	client := rpc.NewWithCustomRPCClient(jsonrpc.NewClientWithOpts(config.RpcURL, &jsonrpc.RPCClientOpts{
+		HTTPClient: httpClient,
+	}))
+	return client, &Endpoints{failover: failover, limiter: limiter}, nil
+}
+
+// checkConcurrency warns when the requested concurrency is more than the
+// configured rate limit can sustain and, if enabled, clamps it.
+func checkConcurrency(config *Config, concurrency int) int {
+	if config.RateLimit <= 0 {
+		return concurrency
+	}
+
+	// Every in-flight transfer spends most of its time polling for status
+	perTransferRate := float64(time.Second) / float64(pollInterval(config, rpc.CommitmentType(config.Commitment)))
+	sustainable := int(config.RateLimit / perTransferRate)
+	if sustainable < 1 {
+		sustainable = 1
+	}
+
+	if concurrency <= sustainable {
+		return concurrency
+	}
+
+	if config.AutoClampConcurrency {
+		log.Printf("Warning: concurrency %d exceeds what %.1f req/s can sustain, clamping to %d",
+			concurrency, config.RateLimit, sustainable)
+		return sustainable
+	}
+
+	log.Printf("Warning: concurrency %d likely exceeds what %.1f req/s can sustain (~%d); expect throttling or 429s. Set auto_clamp_concurrency to clamp automatically",
+		concurrency, config.RateLimit, sustainable)
+	return concurrency
+}
+
+// blockhashCache shares one recent blockhash between all transfers so that
+// each transfer does not have to fetch its own.
+type blockhashCache struct {
+	client *rpc.Client
+	// Blocks before expiry at which the cached blockhash is replaced
+	expiryBuffer uint64
+
+	mu                   sync.RWMutex
+	blockhash            solana.Hash
+	lastValidBlockHeight uint64
+	fetchedHeight        uint64
+	fetchedAt            time.Time
+	// Refresh started by Get that other stale callers wait for, if any
+	refreshing *blockhashRefresh
+}
+
+// blockhashRefresh is a refresh in progress. Its err is set before done is
+// closed.
+type blockhashRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// blockTime is the target time per block, used to estimate the current
+// block height between refreshes without asking the node.
+const blockTime = 400 * time.Millisecond
+
+func newBlockhashCache(client *rpc.Client, expiryBuffer uint64) *blockhashCache {
+	return &blockhashCache{client: client, expiryBuffer: expiryBuffer}
+}
+
+// Get returns the cached blockhash and its last valid block height, fetching
+// it first if the cache is empty or the blockhash is within the expiry buffer.
+func (c *blockhashCache) Get(ctx context.Context) (solana.Hash, uint64, error) {
+	c.mu.RLock()
+	blockhash, lastValid := c.blockhash, c.lastValidBlockHeight
+	expiring := c.expiring()
+	c.mu.RUnlock()
+
+	if !blockhash.IsZero() && !expiring {
+		return blockhash, lastValid, nil
+	}
+
+	if err := c.sharedRefresh(ctx); err != nil {
+		return solana.Hash{}, 0, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.blockhash, c.lastValidBlockHeight, nil
+}
+
+// sharedRefresh refreshes the cache, or waits for the refresh another
+// caller already started, so that any number of callers finding the cache
+// stale at once cause a single fetch.
+func (c *blockhashCache) sharedRefresh(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		refresh := c.refreshing
+		if refresh == nil {
+			refresh = &blockhashRefresh{done: make(chan struct{})}
+			c.refreshing = refresh
+			c.mu.Unlock()
+
+			refresh.err = c.Refresh(ctx)
+			c.mu.Lock()
+			c.refreshing = nil
+			c.mu.Unlock()
+			close(refresh.done)
+			return refresh.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-refresh.done:
+		}
+		// The caller that started it was cancelled, not this one
+		if errors.Is(refresh.err, context.Canceled) || errors.Is(refresh.err, context.DeadlineExceeded) {
+			continue
+		}
+		return refresh.err
+	}
+}
+
+// expiring reports whether the cached blockhash is estimated to be within
+// expiryBuffer blocks of its last valid block height. c.mu must be held.
+func (c *blockhashCache) expiring() bool {
+	if c.expiryBuffer == 0 || c.fetchedHeight == 0 {
+		return false
+	}
+	height := c.fetchedHeight + uint64(time.Since(c.fetchedAt)/blockTime)
+	return height+c.expiryBuffer >= c.lastValidBlockHeight
+}
+
+// Refresh fetches the latest blockhash and replaces the cached one.
+func (c *blockhashCache) Refresh(ctx context.Context) error {
+	latest, err := c.client.GetLatestBlockhash(ctx, rpc.CommitmentFinalized)
+	if err != nil {
+		return fmt.Errorf("failed to get latest blockhash: %w", err)
+	}
+
+	// The block height anchors the expiry estimate; without it the buffer
+	// is simply not applied to this blockhash
+	var height uint64
+	if c.expiryBuffer > 0 {
+		height, err = c.client.GetBlockHeight(ctx, rpc.CommitmentFinalized)
+		if err != nil {
+			log.Printf("Warning: failed to get block height, expiry buffer disabled until next refresh: %v", err)
+			height = 0
+		}
+	}
+
+	c.mu.Lock()
+	c.blockhash = latest.Value.Blockhash
+	c.lastValidBlockHeight = latest.Value.LastValidBlockHeight
+	c.fetchedHeight = height
+	c.fetchedAt = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+// refreshOnInterval refreshes the cache every interval until ctx is done.
+func (c *blockhashCache) refreshOnInterval(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Warning: blockhash refresh failed: %v", err)
+			}
+		}
+	}
+}
+
+// refreshOnSlots refreshes the cache every everySlots slots as reported by the
+// websocket slot subscription. If the subscription cannot be established or
+// breaks, it falls back to refreshing on fallbackInterval.
+func (c *blockhashCache) refreshOnSlots(ctx context.Context, wsURL string, everySlots uint64, fallbackInterval time.Duration) {
+	err := c.watchSlots(ctx, wsURL, everySlots)
+	if ctx.Err() != nil {
+		return
+	}
+
+	log.Printf("Warning: slot subscription failed (%v), falling back to refreshing every %v", err, fallbackInterval)
+	c.refreshOnInterval(ctx, fallbackInterval)
+}
+
+func (c *blockhashCache) watchSlots(ctx context.Context, wsURL string, everySlots uint64) error {
+	wsClient, err := ws.Connect(ctx, wsURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", wsURL, err)
+	}
+	defer wsClient.Close()
+
+	sub, err := wsClient.SlotSubscribe()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to slots: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	// Recv does not take a context, so unblock it by unsubscribing on cancel
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Unsubscribe()
+		case <-done:
+		}
+	}()
+
+	var lastRefreshSlot uint64
+	for {
+		update, err := sub.Recv()
+		if err != nil {
+			return err
+		}
+		if update == nil {
+			// Unsubscribing ends Recv with neither an update nor an error
+			return errors.New("slot subscription closed")
+		}
+
+		if update.Slot < lastRefreshSlot+everySlots {
+			continue
+		}
+		lastRefreshSlot = update.Slot
+
+		if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: blockhash refresh at slot %d failed: %v", update.Slot, err)
+		}
+	}
+}
+
+// WebsocketURL returns ws_url, or the websocket endpoint matching rpc_url.
+func (c *Config) WebsocketURL() string {
+	if c.WsURL != "" {
+		return c.WsURL
+	}
+	return websocketURL(c.RpcURL)
+}
+
+// websocketURL derives the websocket endpoint from an HTTP RPC URL.
+func websocketURL(rpcURL string) string {
+	switch {
+	case strings.HasPrefix(rpcURL, "https://"):
+		return "wss://" + strings.TrimPrefix(rpcURL, "https://")
+	case strings.HasPrefix(rpcURL, "http://"):
+		return "ws://" + strings.TrimPrefix(rpcURL, "http://")
+	default:
+		return rpcURL
+	}
+}
+
+// startBlockhashCache creates the shared blockhash cache and its refresh
+// driver, or returns nil when blockhashes are fetched per transfer.
+func startBlockhashCache(ctx context.Context, client *rpc.Client, config *Config) (*blockhashCache, error) {
+	refreshInterval := time.Duration(config.BlockhashRefreshSeconds) * time.Second
+	if refreshInterval <= 0 {
+		refreshInterval = 20 * time.Second
+	}
+
+	switch config.BlockhashCache {
+	case "":
+		return nil, nil
+	case "interval":
+		cache := newBlockhashCache(client, config.BlockhashExpiryBuffer)
+		if err := cache.Refresh(ctx); err != nil {
+			return nil, err
+		}
+		go cache.refreshOnInterval(ctx, refreshInterval)
+		return cache, nil
+	case "slot":
+		wsURL := config.WebsocketURL()
+		everySlots := config.BlockhashRefreshSlots
+		if everySlots == 0 {
+			everySlots = 10
+		}
+		cache := newBlockhashCache(client, config.BlockhashExpiryBuffer)
+		if err := cache.Refresh(ctx); err != nil {
+			return nil, err
+		}
+		go cache.refreshOnSlots(ctx, wsURL, everySlots, refreshInterval)
+		return cache, nil
+	default:
+		return nil, fmt.Errorf("invalid blockhash_cache %q (expected interval or slot)", config.BlockhashCache)
+	}
+}
+
+// transferRunner holds the shared dependencies used by every transfer in a run.
+type transferRunner struct {
+	client *rpc.Client
+	config *Config
+	oracle *priceOracle
+	state  *stateFile
+	runID  string
+
+	blockhashes *blockhashCache
+	presigned   map[string]presignedTransfer
+	// Clients for broadcast_endpoints
+	broadcast []*rpc.Client
+	// Send rate adapted to confirmation latency, if configured
+	latency *latencyThrottle
+	// Fee payers from fee_payer_keys, if configured
+	payers *feePayerPool
+	// Last number handed out for sequence memos
+	sequence atomic.Uint64
+	// Where progress messages go, if anywhere
+	progress io.Writer
+
+	// Sign only with the keys in the config and leave the rest for an
+	// external party
+	partialSign bool
+	// Return once sent, leaving confirmation to -confirm-submitted
+	submitOnly bool
+
+	rentMu            sync.Mutex
+	rentExemptMinimum uint64
+
+	// What each sender's transfers have spent, for keep_sender_rent_exempt
+	sendersMu sync.Mutex
+	senders   map[string]*senderLedger
+
+	mintsMu sync.Mutex
+	mints   map[solana.PublicKey]mintInfo
+
+	// Start time of every transfer currently executing, for the watchdog
+	inFlightMu sync.Mutex
+	inFlight   map[string]time.Time
+
+	wsMu     sync.Mutex
+	wsClient *ws.Client
+}
+
+// recentBlockhash returns the blockhash to sign with and the last block
+// height at which it is valid, from the shared cache when one is configured.
+func (r *transferRunner) recentBlockhash(ctx context.Context) (solana.Hash, uint64, error) {
+	if r.blockhashes != nil {
+		return r.blockhashes.Get(ctx)
+	}
+
+	latest, err := r.client.GetLatestBlockhash(ctx, rpc.CommitmentFinalized)
+	if err != nil {
+		return solana.Hash{}, 0, err
+	}
+	return latest.Value.Blockhash, latest.Value.LastValidBlockHeight, nil
+}
+
+// readCommitment is the commitment for balance, account and fee reads.
+func (r *transferRunner) readCommitment() rpc.CommitmentType {
+	return rpc.CommitmentType(r.config.ReadCommitment)
+}
+
+// recordState appends the transfer's current state to the state file, if any.
+func (r *transferRunner) recordState(transfer TransferInstruction, result TransferResult, status string) {
+	if r.state == nil {
+		return
+	}
+
+	record := stateRecord{
+		RunID:     r.runID,
+		ID:        transfer.ID,
+		Timestamp: time.Now().UTC(),
+		Endpoint:  r.config.RpcURL,
+		From:      result.FromAccount,
+		To:        transfer.ToAddress,
+		Amount:    result.Amount,
+		Comment:   transfer.Comment,
+		Signature: result.Signature,
+		Status:    status,
+
+		LastValidBlockHeight: result.lastValidBlockHeight,
+	}
+	if result.Error != nil {
+		record.Error = result.Error.Error()
+	}
+
+	if err := r.state.Append(record); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// buildTransaction resolves the transfer amount, then builds and signs the
+// transfer transaction. It fills in result as it learns the amount and
+// accounts so that failures can still be reported with context.
+func (r *transferRunner) buildTransaction(ctx context.Context, transfer *TransferInstruction, result *TransferResult) (*solana.Transaction, error) {
+	// Convert USD-denominated amounts to lamports
+	amount, rate, err := resolveAmount(ctx, *transfer, r.oracle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve amount: %w", err)
+	}
+	if rate > 0 {
+		log.Printf("Converted $%.2f to %d lamports at %.4f USD/SOL for %s",
+			transfer.USDAmount, amount, rate, transfer.ToAddress)
+	}
+	// Lock in the converted amount so rebuilding the transaction later
+	// does not reprice it
+	if rate > 0 {
+		transfer.USDAmount = 0
+		result.USDRate = rate
+	}
+	transfer.Amount = amount
+	result.Amount = amount
+
+	// Decode private key
+	privateKeyBytes, err := base64.StdEncoding.DecodeString(transfer.FromPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode private key: %w", err)
+	}
+
+	// Create account from private key
+	account := solana.NewAccountFromPrivateKeyBytes(privateKeyBytes)
+	result.FromAccount = account.PublicKey().String()
+
+	// Parse destination address
+	destination, err := solana.PublicKeyFromBase58(transfer.ToAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination address: %w", err)
+	}
+	result.ToAccount = destination.String()
+
+	// Create transfer instruction, of SOL or of the transfer's token
+	var instruction solana.Instruction
+	if transfer.Mint != "" {
+		result.Mint = transfer.Mint
+		instruction, err = r.tokenTransferInstruction(ctx, transfer, account.PublicKey(), destination)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := r.checkRentExemption(ctx, destination, transfer.Amount); err != nil {
+			return nil, err
+		}
+		if r.config.KeepSenderRentExempt {
+			if err := r.keepSenderRentExempt(ctx, transfer, account.PublicKey()); err != nil {
+				return nil, err
+			}
+			result.Amount = transfer.Amount
+		}
+		instruction = solana.NewTransferInstruction(
+			transfer.Amount,
+			account.PublicKey(),
+			destination,
+		).Build()
+	}
+
+	// Fee payer, when someone other than the sender pays
+	payer := account.PublicKey()
+	signers := []*solana.Account{account}
+	if transfer.FeePayer == "" && r.payers != nil {
+		pooled := r.payers.Next()
+		payer = pooled.PublicKey()
+		signers = append(signers, pooled)
+	} else if transfer.FeePayer != "" {
+		payer, err = solana.PublicKeyFromBase58(transfer.FeePayer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fee payer: %w", err)
+		}
+		if !payer.Equals(account.PublicKey()) && !r.partialSign {
+			return nil, fmt.Errorf("fee payer %s is not the sender and must co-sign; use -partial-sign", payer)
+		}
+	}
+
+	var instructions []solana.Instruction
+
+	// Get recent blockhash, or the durable nonce standing in for it
+	var recentBlockhash solana.Hash
+	if transfer.NonceAccount != "" {
+		nonceAccount, err := solana.PublicKeyFromBase58(transfer.NonceAccount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nonce account: %w", err)
+		}
+		recentBlockhash, err = durableNonce(ctx, r.client, nonceAccount, r.readCommitment())
+		if err != nil {
+			return nil, err
+		}
+		// Advancing the nonce must be the first instruction
+		instructions = append(instructions, system.NewAdvanceNonceAccountInstruction(
+			nonceAccount,
+			solana.SysVarRecentBlockHashesPubkey,
+			account.PublicKey(),
+		).Build())
+	} else {
+		blockhashStart := time.Now()
+		recentBlockhash, result.lastValidBlockHeight, err = r.recentBlockhash(ctx)
+		result.BlockhashTime = time.Since(blockhashStart)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get recent blockhash: %w", err)
+		}
+	}
+
+	instructions = append(instructions, instruction)
+
+	// The sender's share of a sponsored fee, the whole fee as the only sender
+	if !payer.Equals(account.PublicKey()) {
+		result.SponsoredFee = transferFeeReserve(r.config, transfer) + signatureFee
+		if r.config.ReimburseSponsoredFees {
+			instructions = append(instructions, solana.NewTransferInstruction(
+				result.SponsoredFee,
+				account.PublicKey(),
+				payer,
+			).Build())
+			result.SponsoredReimbursed = true
+		}
+	}
+
+	if r.config.RunMemo != "" {
+		instructions = append(instructions, newMemoInstruction([]byte(r.config.RunMemo), account.PublicKey()))
+	}
+	if transfer.Memo != "" {
+		instructions = append(instructions, newMemoInstruction([]byte(transfer.Memo), account.PublicKey()))
+	}
+
+	// Number the transfer for an on-chain ordering proof
+	if r.config.SequenceMemo {
+		if transfer.sequence == 0 {
+			transfer.sequence = r.sequence.Add(1)
+			transfer.sequenceTime = time.Now().UTC()
+		}
+		result.Sequence = transfer.sequence
+		sequence := fmt.Sprintf("seq:%s:%d:%s", r.runID, transfer.sequence, transfer.sequenceTime.Format(time.RFC3339Nano))
+		instructions = append(instructions, newMemoInstruction([]byte(sequence), account.PublicKey()))
+	}
+
+	// Make otherwise identical transfers distinct on chain
+	if r.config.UniqueMemo || transfer.uniqueMemo {
+		nonce := transferNonce(r.runID, transfer.ID)
+		instructions = append(instructions, newMemoInstruction([]byte(nonce), account.PublicKey()))
+	}
+
+	// Compute budget instructions go first, after any nonce advance
+	budget, err := r.computeBudgetInstructions(ctx, transfer, instructions, recentBlockhash, payer, account)
+	if err != nil {
+		return nil, err
+	}
+	if transfer.NonceAccount != "" {
+		instructions = append(instructions[:1], append(budget, instructions[1:]...)...)
+	} else {
+		instructions = append(budget, instructions...)
+	}
+
+	// Create transaction
+	tx, err := solana.NewTransaction(
+		instructions,
+		recentBlockhash,
+		solana.TransactionPayer(payer),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	// Sign transaction, leaving other signers' slots empty if allowed
+	if r.partialSign {
+		_, err = tx.PartialSign(signerFor(signers...))
+	} else {
+		_, err = tx.Sign(signerFor(signers...))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+
+	if err := checkTransactionSize(tx); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// nonceAccountSize is the size of a system nonce account; the stored nonce
+// follows the version, state and authority fields.
+const (
+	nonceAccountSize   = 80
+	nonceAccountOffset = 40
+)
+
+// durableNonce reads the nonce currently stored in a nonce account, which
+// is used in place of a recent blockhash and does not expire.
+func durableNonce(ctx context.Context, client *rpc.Client, nonceAccount solana.PublicKey, commitment rpc.CommitmentType) (solana.Hash, error) {
+	account, err := client.GetAccountInfoWithOpts(ctx, nonceAccount, &rpc.GetAccountInfoOpts{Commitment: commitment})
+	if err != nil {
+		return solana.Hash{}, fmt.Errorf("failed to get nonce account %s: %w", nonceAccount, err)
+	}
+
+	data := account.GetBinary()
+	if len(data) != nonceAccountSize {
+		return solana.Hash{}, fmt.Errorf("%s is not a nonce account (%d bytes of data)", nonceAccount, len(data))
+	}
+
+	var nonce solana.Hash
+	copy(nonce[:], data[nonceAccountOffset:nonceAccountOffset+32])
+	return nonce, nil
+}
+
+// checkCondition evaluates transfer's condition against the current state
+// of its condition account, returning whether it holds and, if not, why.
+func (r *transferRunner) checkCondition(ctx context.Context, transfer TransferInstruction) (bool, string, error) {
+	address := transfer.ConditionAccount
+	if address == "" {
+		address = transfer.ToAddress
+	}
+	account, err := solana.PublicKeyFromBase58(address)
+	if err != nil {
+		return false, "", fmt.Errorf("invalid condition account: %w", err)
+	}
+
+	// An account exists as long as it holds lamports
+	balance, err := r.client.GetBalance(ctx, account, r.readCommitment())
+	if err != nil {
+		return false, "", fmt.Errorf("failed to get balance of %s: %w", account, err)
+	}
+
+	switch transfer.Condition {
+	case "balance_below":
+		if balance.Value >= transfer.ConditionLamports {
+			return false, fmt.Sprintf("%s has %d lamports, not below %d", account, balance.Value, transfer.ConditionLamports), nil
+		}
+	case "account_exists":
+		if balance.Value == 0 {
+			return false, fmt.Sprintf("%s does not exist", account), nil
+		}
+	case "account_missing":
+		if balance.Value > 0 {
+			return false, fmt.Sprintf("%s already exists", account), nil
+		}
+	}
+	return true, "", nil
+}
+
+// runCanary sends the canary transfer and waits for its outcome, returning
+// the canary's error if it did not succeed in time.
+func (r *transferRunner) runCanary(ctx context.Context, canary *CanaryConfig, sender string) error {
+	timeout := time.Duration(canary.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	transfer := TransferInstruction{
+		ID:             "canary-" + r.runID,
+		FromPrivateKey: canary.FromPrivateKey,
+		ToAddress:      canary.ToAddress,
+		Amount:         canary.Amount,
+	}
+	if transfer.FromPrivateKey == "" {
+		transfer.FromPrivateKey = sender
+	}
+
+	// The batch waits on the canary, so it has to be confirmed even when the
+	// batch itself is submit-only
+	submitOnly := r.submitOnly
+	r.submitOnly = false
+	defer func() { r.submitOnly = submitOnly }()
+
+	var wg sync.WaitGroup
+	results := make(chan TransferResult, 1)
+	wg.Add(1)
+	r.executeTransfer(ctx, transfer, &wg, results)
+	result := <-results
+
+	switch {
+	case result.Status == "Confirmed":
+		r.printf("✅ Canary %s confirmed in %v (%s)\n", transfer.ID, result.ProcessingTime, result.Signature)
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("not confirmed within %v (status %s): %v", timeout, newResultRecord(result).Status, result.Error)
+	case result.Error != nil:
+		return result.Error
+	default:
+		return fmt.Errorf("ended with status %s", newResultRecord(result).Status)
+	}
+}
+
+// checkRentExemption warns about or rejects, per rent_exempt_check, a
+// transfer that would create destination with less than the rent-exempt
+// minimum, leaving an account that cannot hold the funds.
+func (r *transferRunner) checkRentExemption(ctx context.Context, destination solana.PublicKey, amount uint64) error {
+	if r.config.RentExemptCheck == "" {
+		return nil
+	}
+
+	balance, err := r.client.GetBalance(ctx, destination, r.readCommitment())
+	if err != nil {
+		return fmt.Errorf("failed to get balance of %s: %w", destination, err)
+	}
+	if balance.Value > 0 {
+		// Existing account, already funded
+		return nil
+	}
+
+	minimum, err := r.rentExemptMinimumBalance(ctx)
+	if err != nil {
+		return err
+	}
+	if amount >= minimum {
+		return nil
+	}
+
+	err = fmt.Errorf("%s is a new account and %d lamports is below the rent-exempt minimum of %d", destination, amount, minimum)
+	if r.config.RentExemptCheck == "fail" {
+		return err
+	}
+	log.Printf("Warning: %v", err)
+	return nil
+}
+
+// senderLedger is a sender's balance, read once, and what its transfers in
+// this run have reserved against it. Concurrent or presigned transfers would
+// otherwise each check the whole balance.
+type senderLedger struct {
+	mu       sync.Mutex
+	read     bool
+	balance  uint64
+	reserved map[string]uint64
+}
+
+// senderLedger returns the ledger for sender, creating it on first use.
+func (r *transferRunner) senderLedger(sender string) *senderLedger {
+	r.sendersMu.Lock()
+	defer r.sendersMu.Unlock()
+
+	if r.senders == nil {
+		r.senders = make(map[string]*senderLedger)
+	}
+	ledger, ok := r.senders[sender]
+	if !ok {
+		ledger = &senderLedger{reserved: make(map[string]uint64)}
+		r.senders[sender] = ledger
+	}
+	return ledger
+}
+
+// releaseSenderSpend drops what transfer reserved from sender's balance once
+// it is known not to have landed.
+func (r *transferRunner) releaseSenderSpend(sender, transferID string) {
+	ledger := r.senderLedger(sender)
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	delete(ledger.reserved, transferID)
+}
+
+// keepSenderRentExempt lowers transfer's amount so the sender keeps at least
+// the rent-exempt minimum, unless the transfer empties it, which the runtime
+// allows. The fee the sender pays is set aside too. The check and the
+// reservation of what the transfer spends happen under the sender's ledger
+// lock, so other transfers from the sender see the balance net of it.
+func (r *transferRunner) keepSenderRentExempt(ctx context.Context, transfer *TransferInstruction, sender solana.PublicKey) error {
+	ledger := r.senderLedger(sender.String())
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	if !ledger.read {
+		result, err := r.client.GetBalance(ctx, sender, r.readCommitment())
+		if err != nil {
+			return fmt.Errorf("failed to get balance of %s: %w", sender, err)
+		}
+		ledger.balance, ledger.read = result.Value, true
+	}
+
+	// A rebuild replaces the transfer's earlier reservation
+	delete(ledger.reserved, transfer.ID)
+	var reserved uint64
+	for _, amount := range ledger.reserved {
+		reserved += amount
+	}
+	var balance uint64
+	if ledger.balance > reserved {
+		balance = ledger.balance - reserved
+	}
+	minimum, err := r.rentExemptMinimumBalance(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A separate fee payer only costs the sender what it repays
+	fee := transferFeeReserve(r.config, transfer)
+	if transfer.FeePayer != "" || r.payers != nil {
+		fee = 0
+		if r.config.ReimburseSponsoredFees {
+			fee = transferFeeReserve(r.config, transfer) + signatureFee
+		}
+	}
+
+	spend := transfer.Amount + fee
+	if spend < balance && balance-spend < minimum {
+		if balance < fee+minimum+1 {
+			return fmt.Errorf("sender %s has %d lamports left, too little to send anything and stay rent-exempt (%d lamports)", sender, balance, minimum)
+		}
+		adjusted := balance - fee - minimum
+		log.Printf("Warning: lowering transfer %s from %d to %d lamports to keep sender %s rent-exempt", transfer.ID, transfer.Amount, adjusted, sender)
+		transfer.Amount = adjusted
+		spend = adjusted + fee
+	}
+	ledger.reserved[transfer.ID] = spend
+	return nil
+}
+
+// rentExemptMinimumBalance returns the rent-exempt minimum for an account
+// without data, fetched once per run.
+func (r *transferRunner) rentExemptMinimumBalance(ctx context.Context) (uint64, error) {
+	r.rentMu.Lock()
+	defer r.rentMu.Unlock()
+
+	if r.rentExemptMinimum == 0 {
+		minimum, err := r.client.GetMinimumBalanceForRentExemption(ctx, 0, r.readCommitment())
+		if err != nil {
+			return 0, fmt.Errorf("failed to get rent-exempt minimum: %w", err)
+		}
+		r.rentExemptMinimum = minimum
+	}
+	return r.rentExemptMinimum, nil
+}
+
+// Offsets into the SPL token mint and token account layouts, which Token-2022
+// shares for its base fields.
+const (
+	mintDecimalsOffset = 44
+	tokenAccountSize   = 165
+)
+
+// tokenTransferChecked is the SPL token TransferChecked instruction index.
+const tokenTransferChecked = 12
+
+// token2022ProgramID is the Token-2022 program, which shares the SPL token
+// instruction layout.
+var token2022ProgramID = solana.MustPublicKeyFromBase58("TokenzQdBNbLqP5VEhdkAS6EPFLC1PHnBqCXEpPxuEb")
+
+// mintInfo is what a token transfer needs to know about its mint.
+type mintInfo struct {
+	program  solana.PublicKey
+	decimals uint8
+}
+
+// mintInfo returns the owning token program and decimals of mint, fetched
+// once per run.
+func (r *transferRunner) mintInfo(ctx context.Context, mint solana.PublicKey) (mintInfo, error) {
+	r.mintsMu.Lock()
+	defer r.mintsMu.Unlock()
+
+	if info, ok := r.mints[mint]; ok {
+		return info, nil
+	}
+
+	account, err := r.client.GetAccountInfoWithOpts(ctx, mint, &rpc.GetAccountInfoOpts{Commitment: r.readCommitment()})
+	if err != nil {
+		return mintInfo{}, fmt.Errorf("failed to get mint %s: %w", mint, err)
+	}
+	data := account.GetBinary()
+	if len(data) <= mintDecimalsOffset {
+		return mintInfo{}, fmt.Errorf("%s is not a mint (%d bytes of data)", mint, len(data))
+	}
+
+	info := mintInfo{program: account.Value.Owner, decimals: data[mintDecimalsOffset]}
+	if r.mints == nil {
+		r.mints = make(map[solana.PublicKey]mintInfo)
+	}
+	r.mints[mint] = info
+	return info, nil
+}
+
+// associatedTokenAddress derives wallet's associated token account for mint
+// under tokenProgram, so that Token-2022 mints resolve to the right address.
+func associatedTokenAddress(wallet, mint, tokenProgram solana.PublicKey) (solana.PublicKey, error) {
+	address, _, err := solana.FindProgramAddress([][]byte{
+		wallet[:],
+		tokenProgram[:],
+		mint[:],
+	}, solana.SPLAssociatedTokenAccountProgramID)
+	return address, err
+}
+
+// tokenTransferInstruction builds a TransferChecked of transfer's mint from
+// the sender's associated token account to the recipient's, or to
+// token_account when given. The recipient account must already exist and
+// hold the same mint.
+func (r *transferRunner) tokenTransferInstruction(ctx context.Context, transfer *TransferInstruction, sender, recipient solana.PublicKey) (solana.Instruction, error) {
+	mint, err := solana.PublicKeyFromBase58(transfer.Mint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mint: %w", err)
+	}
+	info, err := r.mintInfo(ctx, mint)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := associatedTokenAddress(sender, mint, info.program)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive sender token account: %w", err)
+	}
+
+	var destination solana.PublicKey
+	if transfer.TokenAccount != "" {
+		destination, err = solana.PublicKeyFromBase58(transfer.TokenAccount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token account: %w", err)
+		}
+	} else {
+		destination, err = associatedTokenAddress(recipient, mint, info.program)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive recipient token account: %w", err)
+		}
+	}
+
+	// Catch a token account for another mint before the program rejects it
+	account, err := r.client.GetAccountInfoWithOpts(ctx, destination, &rpc.GetAccountInfoOpts{Commitment: r.readCommitment()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recipient token account %s: %w", destination, err)
+	}
+	data := account.GetBinary()
+	if !account.Value.Owner.Equals(info.program) || len(data) < tokenAccountSize {
+		return nil, fmt.Errorf("%s is not a token account of %s", destination, info.program)
+	}
+	if accountMint := solana.PublicKeyFromBytes(data[:32]); !accountMint.Equals(mint) {
+		return nil, fmt.Errorf("token account %s holds mint %s, not %s", destination, accountMint, mint)
+	}
+
+	data = make([]byte, 10)
+	data[0] = tokenTransferChecked
+	binary.LittleEndian.PutUint64(data[1:], transfer.Amount)
+	data[9] = info.decimals
+
+	return solana.NewInstruction(info.program, solana.AccountMetaSlice{
+		solana.Meta(source).WRITE(),
+		solana.Meta(mint),
+		solana.Meta(destination).WRITE(),
+		solana.Meta(sender).SIGNER(),
+	}, data), nil
+}
+
+// blockhashValidity is how long a blockhash-signed transaction is treated as
+// sendable. Blockhashes expire after 150 blocks, roughly 60-90 seconds.
+const blockhashValidity = 60 * time.Second
+
+// presignedTransfer is a transaction signed ahead of its send time together
+// with the transfer and result it was built from.
+type presignedTransfer struct {
+	tx       *solana.Transaction
+	transfer TransferInstruction
+	result   TransferResult
+	signedAt time.Time
+}
+
+// presignTransfers signs every transfer up front, locking in recipients and
+// amounts, so that only broadcasting is left for the send slot.
+func (r *transferRunner) presignTransfers(ctx context.Context, transfers []TransferInstruction) {
+	r.presigned = make(map[string]presignedTransfer, len(transfers))
+	for _, transfer := range transfers {
+		result := TransferResult{ID: transfer.ID}
+		tx, err := r.buildTransaction(ctx, &transfer, &result)
+		if err != nil {
+			// Leave it to executeTransfer to report the failure
+			log.Printf("Warning: failed to presign transfer %s: %v", transfer.ID, err)
+			continue
+		}
+		r.presigned[transfer.ID] = presignedTransfer{
+			tx:       tx,
+			transfer: transfer,
+			result:   result,
+			signedAt: time.Now(),
+		}
+	}
+	r.printf("Signed %d of %d transfers ahead of slot %d\n", len(r.presigned), len(transfers), r.config.SendAtSlot)
+}
+
+// transactionFor returns the transaction to send for transfer: the
+// presigned one while it is still valid, otherwise a freshly built one.
+// Durable nonce transactions never expire; blockhash ones are rebuilt with
+// the amount locked in at presign time.
+func (r *transferRunner) transactionFor(ctx context.Context, transfer *TransferInstruction, result *TransferResult) (*solana.Transaction, error) {
+	presigned, ok := r.presigned[transfer.ID]
+	if !ok {
+		return r.buildTransaction(ctx, transfer, result)
+	}
+
+	*transfer = presigned.transfer
+	*result = presigned.result
+	if transfer.NonceAccount != "" || time.Since(presigned.signedAt) < blockhashValidity {
+		return presigned.tx, nil
+	}
+
+	log.Printf("Presigned transaction for transfer %s may have expired, re-signing with a fresh blockhash", transfer.ID)
+	return r.buildTransaction(ctx, transfer, result)
+}
+
+// waitForSlot blocks until the node reports slot or later.
+func waitForSlot(ctx context.Context, client *rpc.Client, slot uint64) error {
+	lastLog := time.Now()
+	for {
+		current, err := client.GetSlot(ctx, rpc.CommitmentProcessed)
+		if err != nil {
+			return fmt.Errorf("failed to get slot: %w", err)
+		}
+		if current >= slot {
+			return nil
+		}
+
+		if time.Since(lastLog) >= 10*time.Second {
+			log.Printf("Waiting for slot %d, currently at %d (%d to go)", slot, current, slot-current)
+			lastLog = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(400 * time.Millisecond):
+		}
+	}
+}
+
+// checkSlotProgress samples the node's slot at the start and end of window
+// and fails if it did not advance, since a stuck node accepts transactions
+// that never land. Progress far below the ~400ms slot time is only a warning.
+func checkSlotProgress(ctx context.Context, client *rpc.Client, window time.Duration) error {
+	first, err := client.GetSlot(ctx, rpc.CommitmentProcessed)
+	if err != nil {
+		return fmt.Errorf("failed to get slot: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(window):
+	}
+
+	last, err := client.GetSlot(ctx, rpc.CommitmentProcessed)
+	if err != nil {
+		return fmt.Errorf("failed to get slot: %w", err)
+	}
+	if last <= first {
+		return fmt.Errorf("node is stale: slot stuck at %d for %v", first, window)
+	}
+
+	expected := uint64(window / blockTime)
+	if advanced := last - first; advanced < expected/4 {
+		log.Printf("Warning: node advanced only %d slots in %v (expected ~%d), it may be lagging", advanced, window, expected)
+	}
+	return nil
+}
+
+// signerFor returns a tx.Sign key getter that signs for accounts only.
+func signerFor(accounts ...*solana.Account) func(solana.PublicKey) *solana.PrivateKey {
+	return func(key solana.PublicKey) *solana.PrivateKey {
+		for _, account := range accounts {
+			if account.PublicKey().Equals(key) {
+				return &account.PrivateKey
+			}
+		}
+		return nil
+	}
+}
+
+// maxComputeUnitLimit is the most compute units a transaction may request.
+const maxComputeUnitLimit = 1_400_000
+
+// computeBudgetInstructions returns the compute budget instructions to
+// prepend to transfer's instructions, simulating them first when the unit
+// limit is sized automatically.
+func (r *transferRunner) computeBudgetInstructions(ctx context.Context, transfer *TransferInstruction, instructions []solana.Instruction, blockhash solana.Hash, payer solana.PublicKey, signer *solana.Account) ([]solana.Instruction, error) {
+	price, limit := transferBudget(r.config, transfer)
+	simulate := r.config.AutoComputeUnitLimit && transfer.ComputeUnitLimit == 0
+	return r.budgetInstructions(ctx, instructions, blockhash, payer, signer, price, limit, simulate)
+}
+
+// batchComputeBudgetInstructions returns the compute budget of a transaction
+// packing several operations: one price and one limit for the whole
+// transaction. A fixed compute_unit_limit is sized for a single transfer, so
+// with a priority fee the limit is always sized from simulating the batch.
+func (r *transferRunner) batchComputeBudgetInstructions(ctx context.Context, instructions []solana.Instruction, blockhash solana.Hash, payer solana.PublicKey, signer *solana.Account) ([]solana.Instruction, error) {
+	simulate := r.config.AutoComputeUnitLimit || r.config.ComputeUnitPrice > 0 || r.config.ComputeUnitLimit > 0
+	return r.budgetInstructions(ctx, instructions, blockhash, payer, signer, r.config.ComputeUnitPrice, r.config.ComputeUnitLimit, simulate)
+}
+
+// budgetInstructions builds the SetComputeUnitPrice and SetComputeUnitLimit
+// instructions for price and limit, sizing the limit from a simulation
+// instead if simulate is set.
+func (r *transferRunner) budgetInstructions(ctx context.Context, instructions []solana.Instruction, blockhash solana.Hash, payer solana.PublicKey, signer *solana.Account, price uint64, limit uint32, simulate bool) ([]solana.Instruction, error) {
+	var budget []solana.Instruction
+	if price > 0 {
+		budget = append(budget, computebudget.NewSetComputeUnitPriceInstruction(price).Build())
+	}
+
+	if simulate {
+		units, err := simulateComputeUnits(ctx, r.client, budget, instructions, blockhash, payer, signer)
+		if err != nil {
+			return nil, err
+		}
+
+		margin := r.config.ComputeUnitMarginPercent
+		if margin <= 0 {
+			margin = 10
+		}
+		sized := units + units*uint64(margin)/100
+		if sized > maxComputeUnitLimit {
+			sized = maxComputeUnitLimit
+		}
+		limit = uint32(sized)
+	}
+
+	if limit > 0 {
+		budget = append(budget, computebudget.NewSetComputeUnitLimitInstruction(limit).Build())
+	}
+	return budget, nil
+}
+
+// simulateComputeUnits simulates the transaction with the maximum unit limit
+// and returns the compute units it consumed. The limit instruction is part
+// of the simulation so its own cost is accounted for. Signatures are not
+// verified, so signers other than signer may be missing.
+func simulateComputeUnits(ctx context.Context, client *rpc.Client, budget, instructions []solana.Instruction, blockhash solana.Hash, payer solana.PublicKey, signer *solana.Account) (uint64, error) {
+	simulated := append([]solana.Instruction{}, budget...)
+	simulated = append(simulated, computebudget.NewSetComputeUnitLimitInstruction(maxComputeUnitLimit).Build())
+	simulated = append(simulated, instructions...)
+
+	tx, err := solana.NewTransaction(simulated, blockhash, solana.TransactionPayer(payer))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create simulation transaction: %w", err)
+	}
+	if _, err := tx.PartialSign(signerFor(signer)); err != nil {
+		return 0, fmt.Errorf("failed to sign simulation transaction: %w", err)
+	}
+
+	sim, err := client.SimulateTransactionWithOpts(ctx, tx, &rpc.SimulateTransactionOpts{
+		Commitment:             rpc.CommitmentConfirmed,
+		ReplaceRecentBlockhash: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to simulate transaction: %w", err)
+	}
+	if sim.Value.Err != nil {
+		return 0, fmt.Errorf("simulation failed: %v (logs: %s)", sim.Value.Err, strings.Join(sim.Value.Logs, "; "))
+	}
+	if sim.Value.UnitsConsumed == nil {
+		return 0, fmt.Errorf("simulation did not report units consumed")
+	}
+
+	return *sim.Value.UnitsConsumed, nil
+}
+
+// maxTransactionSize is the largest serialized transaction the cluster
+// accepts (PACKET_DATA_SIZE).
+const maxTransactionSize = 1232
+
+// transactionTooLargeError reports a transaction over maxTransactionSize with
+// enough detail to tell which part of it to shrink.
+type transactionTooLargeError struct {
+	Size             int
+	Instructions     int
+	LargestData      int
+	LargestDataIndex int
+	RejectedByNode   bool
+}
+
+func (e *transactionTooLargeError) Error() string {
+	msg := fmt.Sprintf("transaction is %d bytes, %d over the %d byte limit", e.Size, e.Size-maxTransactionSize, maxTransactionSize)
+	if e.RejectedByNode {
+		msg = fmt.Sprintf("transaction of %d bytes rejected by the node as too large", e.Size)
+	}
+	return fmt.Sprintf("%s (%d instructions, largest instruction data %d bytes in instruction #%d); shorten the memo or remove additional instructions",
+		msg, e.Instructions, e.LargestData, e.LargestDataIndex)
+}
+
+// newTransactionTooLargeError describes tx's size and the instruction that
+// contributes the most data to it.
+func newTransactionTooLargeError(tx *solana.Transaction, size int) *transactionTooLargeError {
+	e := &transactionTooLargeError{
+		Size:         size,
+		Instructions: len(tx.Message.Instructions),
+	}
+	for i, instruction := range tx.Message.Instructions {
+		if len(instruction.Data) > e.LargestData {
+			e.LargestData = len(instruction.Data)
+			e.LargestDataIndex = i
+		}
+	}
+	return e
+}
+
+// checkTransactionSize rejects transactions the cluster would refuse, before
+// they are sent.
+func checkTransactionSize(tx *solana.Transaction) error {
+	data, err := tx.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to serialize transaction: %w", err)
+	}
+	if len(data) > maxTransactionSize {
+		return newTransactionTooLargeError(tx, len(data))
+	}
+	return nil
+}
+
+// isTooLargeError reports whether the node rejected a transaction for size.
+func isTooLargeError(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "too large")
+}
+
+// estimateFee asks the node what the transaction's message would cost.
+func estimateFee(ctx context.Context, client *rpc.Client, tx *solana.Transaction, commitment rpc.CommitmentType) (uint64, error) {
+	message, err := tx.Message.MarshalBinary()
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	fee, err := client.GetFeeForMessage(ctx, base64.StdEncoding.EncodeToString(message), commitment)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get fee for message: %w", err)
+	}
+	// A nil value means the node no longer knows the blockhash
+	if fee.Value == nil {
+		return 0, fmt.Errorf("fee unavailable, blockhash expired")
+	}
+
+	return *fee.Value, nil
+}
+
+// transactionMetadata is the part of a confirmed transaction's metadata
+// this tool reads. It is decoded from the raw getTransaction response since
+// rpc.TransactionMeta has no computeUnitsConsumed.
+type transactionMetadata struct {
+	Fee uint64 `json:"fee"`
+	// Missing on older nodes
+	ComputeUnitsConsumed *uint64 `json:"computeUnitsConsumed"`
+}
+
+// errTransactionNotFound reports a transaction getTransaction does not
+// return, which includes one not yet confirmed.
+var errTransactionNotFound = errors.New("transaction not found")
+
+// metaWaitTimeout bounds how long waitForMeta waits for a transaction
+// confirmed at processed to become visible at confirmed.
+const metaWaitTimeout = 10 * time.Second
+
+// transactionMeta reads the metadata of a confirmed transaction.
+func transactionMeta(ctx context.Context, client *rpc.Client, sig solana.Signature) (*transactionMetadata, error) {
+	var tx *struct {
+		Meta *transactionMetadata `json:"meta"`
+	}
+	err := client.RPCCallForInto(ctx, &tx, "getTransaction", []interface{}{
+		sig.String(),
+		map[string]interface{}{
+			"commitment":                     rpc.CommitmentConfirmed,
+			"encoding":                       "base64",
+			"maxSupportedTransactionVersion": 0,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction: %w", err)
+	}
+	if tx == nil {
+		return nil, errTransactionNotFound
+	}
+	if tx.Meta == nil {
+		return nil, fmt.Errorf("transaction has no metadata")
+	}
+
+	return tx.Meta, nil
+}
+
+// waitForMeta reads the metadata of sig like transactionMeta, polling for up
+// to metaWaitTimeout while the transaction is not found, since
+// getTransaction only serves confirmed transactions and the transfer may
+// have been confirmed at processed.
+func (r *transferRunner) waitForMeta(ctx context.Context, sig solana.Signature) (*transactionMetadata, error) {
+	deadline := time.Now().Add(metaWaitTimeout)
+	for {
+		meta, err := transactionMeta(ctx, r.client, sig)
+		if !errors.Is(err, errTransactionNotFound) || time.Now().After(deadline) {
+			return meta, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(statusPollInterval):
+		}
+	}
+}
+
+// actualFee reads the fee charged for a confirmed transaction.
+func actualFee(ctx context.Context, client *rpc.Client, sig solana.Signature) (uint64, error) {
+	meta, err := transactionMeta(ctx, client, sig)
+	if err != nil {
+		return 0, err
+	}
+	return meta.Fee, nil
+}
+
+// newMemoInstruction builds a Memo program instruction carrying data and
+// signed by signer.
+func newMemoInstruction(data []byte, signer solana.PublicKey) solana.Instruction {
+	return solana.NewInstruction(solana.MemoProgramID, solana.AccountMetaSlice{
+		solana.NewAccountMeta(signer, false, true),
+	}, data)
+}
+
+// describeInstruction decodes the instructions this tool builds into a
+// one-line human readable summary, falling back to the raw data size.
+func describeInstruction(programID solana.PublicKey, data []byte) string {
+	switch {
+	case programID.Equals(system.ProgramID) && len(data) >= 4:
+		switch binary.LittleEndian.Uint32(data) {
+		case 2:
+			if len(data) >= 12 {
+				lamports := binary.LittleEndian.Uint64(data[4:])
+				return fmt.Sprintf("System: Transfer %d lamports (%.9f SOL)", lamports, float64(lamports)/float64(solana.LAMPORTS_PER_SOL))
+			}
+		case 4:
+			return "System: AdvanceNonceAccount"
+		}
+		return fmt.Sprintf("System: instruction %d", binary.LittleEndian.Uint32(data))
+	case (programID.Equals(solana.TokenProgramID) || programID.Equals(token2022ProgramID)) && len(data) >= 10 && data[0] == tokenTransferChecked:
+		return fmt.Sprintf("Token: TransferChecked %d base units (%d decimals)", binary.LittleEndian.Uint64(data[1:]), data[9])
+	case programID.Equals(solana.SPLAssociatedTokenAccountProgramID) && len(data) == 1 && data[0] == 1:
+		return "AssociatedToken: CreateIdempotent"
+	case programID.Equals(solana.MemoProgramID):
+		return fmt.Sprintf("Memo: %q", string(data))
+	case programID.Equals(computebudget.ProgramID) && len(data) >= 1:
+		switch data[0] {
+		case 2:
+			if len(data) >= 5 {
+				return fmt.Sprintf("ComputeBudget: SetComputeUnitLimit %d units", binary.LittleEndian.Uint32(data[1:]))
+			}
+		case 3:
+			if len(data) >= 9 {
+				return fmt.Sprintf("ComputeBudget: SetComputeUnitPrice %d micro-lamports/unit", binary.LittleEndian.Uint64(data[1:]))
+			}
+		}
+		return fmt.Sprintf("ComputeBudget: instruction %d", data[0])
+	}
+	return fmt.Sprintf("%d bytes of data", len(data))
+}
+
+// explainTransaction prints the payer, signers and decoded instructions of
+// tx for manual review.
+func explainTransaction(tx *solana.Transaction) {
+	message := tx.Message
+	keys := message.AccountKeys
+
+	if len(keys) > 0 {
+		fmt.Printf("   Fee Payer: %s\n", keys[0])
+	}
+	fmt.Printf("   Recent Blockhash: %s\n", message.RecentBlockhash)
+	fmt.Println("   Signers:")
+	for i := 0; i < int(message.Header.NumRequiredSignatures) && i < len(keys); i++ {
+		fmt.Printf("      %s\n", keys[i])
+	}
+
+	fmt.Println("   Instructions:")
+	for i, instruction := range message.Instructions {
+		if int(instruction.ProgramIDIndex) >= len(keys) {
+			fmt.Printf("      #%d: invalid program index %d\n", i, instruction.ProgramIDIndex)
+			continue
+		}
+		programID := keys[instruction.ProgramIDIndex]
+		fmt.Printf("      #%d %s\n", i, describeInstruction(programID, instruction.Data))
+		fmt.Printf("         Program: %s\n", programID)
+		for _, index := range instruction.Accounts {
+			if int(index) >= len(keys) {
+				continue
+			}
+			key := keys[index]
+			var flags []string
+			if message.IsSigner(key) {
+				flags = append(flags, "signer")
+			}
+			if writable, err := message.IsWritable(key); err == nil && writable {
+				flags = append(flags, "writable")
+			}
+			fmt.Printf("         Account: %s %s\n", key, strings.Join(flags, ", "))
+		}
+	}
+}
+
+// DecodeTransactionFile prints the decoded structure of the base64
+// transaction in path, such as one printed by -partial-sign, without
+// touching the network.
+func DecodeTransactionFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("%s is not base64: %w", path, err)
+	}
+
+	decoder := bin.NewBinDecoder(raw)
+	tx, err := solana.TransactionFromDecoder(decoder)
+	if err != nil {
+		return fmt.Errorf("failed to decode transaction: %w", err)
+	}
+
+	fmt.Printf("Transaction (%d bytes):\n", len(raw))
+	if remaining := decoder.Remaining(); remaining > 0 {
+		fmt.Printf("   Warning: %d trailing bytes after the transaction\n", remaining)
+	}
+	fmt.Println("   Signatures:")
+	keys := tx.Message.AccountKeys
+	for i, signature := range tx.Signatures {
+		signer := "unknown signer"
+		if i < len(keys) {
+			signer = keys[i].String()
+		}
+		if signature.IsZero() {
+			fmt.Printf("      %s: missing\n", signer)
+		} else {
+			fmt.Printf("      %s: %s\n", signer, signature)
+		}
+	}
+	if missing := missingSigners(tx); len(missing) == 0 {
+		if err := tx.VerifySignatures(); err != nil {
+			fmt.Printf("   Signatures do not verify: %v\n", err)
+		} else {
+			fmt.Println("   Signatures verify")
+		}
+	}
+	explainTransaction(tx)
+	return nil
+}
+
+// explainTransfers builds every transfer and prints a decoded view of the
+// transaction and its estimated fee without sending anything.
+func (r *transferRunner) explainTransfers(ctx context.Context, transfers []TransferInstruction) error {
+	var failed int
+	for _, transfer := range transfers {
+		result := TransferResult{ID: transfer.ID}
+
+		fmt.Printf("\nTransfer %s:\n", transfer.ID)
+		tx, err := r.buildTransaction(ctx, &transfer, &result)
+		if err != nil {
+			failed++
+			report("   ❌ %v\n", err)
+			continue
+		}
+
+		explainTransaction(tx)
+		if fee, err := estimateFee(ctx, r.client, tx, r.readCommitment()); err != nil {
+			fmt.Printf("   Estimated Fee: unavailable (%v)\n", err)
+		} else {
+			fmt.Printf("   Estimated Fee: %d lamports\n", fee)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d transfers could not be built", failed)
+	}
+	return nil
+}
+
+// missingSigners returns the required signers of tx that have not signed yet.
+func missingSigners(tx *solana.Transaction) []solana.PublicKey {
+	var missing []solana.PublicKey
+	keys := tx.Message.AccountKeys
+	for i := 0; i < int(tx.Message.Header.NumRequiredSignatures) && i < len(keys); i++ {
+		if i >= len(tx.Signatures) || tx.Signatures[i].IsZero() {
+			missing = append(missing, keys[i])
+		}
+	}
+	return missing
+}
+
+// ataBatchSize is how many associated token accounts -create-atas-only
+// creates per transaction, well within the transaction size limit.
+const ataBatchSize = 8
+
+// createATAInstruction is the associated token program's CreateIdempotent
+// instruction, which succeeds if the account already exists.
+func createATAInstruction(payer, ata, wallet, mint, tokenProgram solana.PublicKey) solana.Instruction {
+	return solana.NewInstruction(solana.SPLAssociatedTokenAccountProgramID, solana.AccountMetaSlice{
+		solana.Meta(payer).WRITE().SIGNER(),
+		solana.Meta(ata).WRITE(),
+		solana.Meta(wallet),
+		solana.Meta(mint),
+		solana.Meta(system.ProgramID),
+		solana.Meta(tokenProgram),
+	}, []byte{1})
+}
+
+// pendingATA is a recipient token account -create-atas-only has to create.
+type pendingATA struct {
+	address, wallet, mint, program solana.PublicKey
+}
+
+// createATAs creates the missing associated token accounts of the token
+// transfers' recipients, several per transaction paid by the sender, and
+// reports which were created, which already existed and the rent paid.
+// Nothing is transferred.
+func (r *transferRunner) createATAs(ctx context.Context, transfers []TransferInstruction) error {
+	var existing, failed int
+	seen := make(map[solana.PublicKey]bool)
+	missing := make(map[solana.PublicKey][]pendingATA)
+	payers := make(map[solana.PublicKey]*solana.Account)
+	var payerOrder []solana.PublicKey
+
+	fmt.Println("\nAssociated Token Accounts:")
+	fmt.Println("==========================")
+
+	for _, transfer := range transfers {
+		// An explicit token_account is not an ATA to create
+		if transfer.Mint == "" || transfer.TokenAccount != "" {
+			continue
+		}
+
+		privateKeyBytes, err := base64.StdEncoding.DecodeString(transfer.FromPrivateKey)
+		if err != nil {
+			failed++
+			report("❌ Transfer %s: failed to decode private key: %v\n", transfer.ID, err)
+			continue
+		}
+		account := solana.NewAccountFromPrivateKeyBytes(privateKeyBytes)
+		wallet, err := solana.PublicKeyFromBase58(transfer.ToAddress)
+		if err != nil {
+			failed++
+			report("❌ Transfer %s: invalid destination address: %v\n", transfer.ID, err)
+			continue
+		}
+		mint, err := solana.PublicKeyFromBase58(transfer.Mint)
+		if err != nil {
+			failed++
+			report("❌ Transfer %s: invalid mint: %v\n", transfer.ID, err)
+			continue
+		}
+		info, err := r.mintInfo(ctx, mint)
+		if err != nil {
+			failed++
+			report("❌ Transfer %s: %v\n", transfer.ID, err)
+			continue
+		}
+		ata, err := associatedTokenAddress(wallet, mint, info.program)
+		if err != nil {
+			failed++
+			report("❌ Transfer %s: failed to derive token account: %v\n", transfer.ID, err)
+			continue
+		}
+		if seen[ata] {
+			continue
+		}
+		seen[ata] = true
+
+		_, err = r.client.GetAccountInfoWithOpts(ctx, ata, &rpc.GetAccountInfoOpts{Commitment: r.readCommitment()})
+		switch {
+		case err == nil:
+			existing++
+			report("•  %s for %s (mint %s) already exists\n", ata, wallet, mint)
+			continue
+		case !errors.Is(err, rpc.ErrNotFound):
+			failed++
+			report("❌ Transfer %s: failed to get token account %s: %v\n", transfer.ID, ata, err)
+			continue
+		}
+
+		payer := account.PublicKey()
+		if payers[payer] == nil {
+			payers[payer] = account
+			payerOrder = append(payerOrder, payer)
+		}
+		missing[payer] = append(missing[payer], pendingATA{address: ata, wallet: wallet, mint: mint, program: info.program})
+	}
+
+	var created int
+	var rentPaid uint64
+	for _, payer := range payerOrder {
+		pending := missing[payer]
+		for start := 0; start < len(pending); start += ataBatchSize {
+			end := start + ataBatchSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+			batch := pending[start:end]
+
+			if err := r.sendATABatch(ctx, payers[payer], batch); err != nil {
+				failed += len(batch)
+				for _, ata := range batch {
+					report("❌ %s for %s (mint %s): %v\n", ata.address, ata.wallet, ata.mint, err)
+				}
+				continue
+			}
+
+			for _, ata := range batch {
+				created++
+				balance, err := r.client.GetBalance(ctx, ata.address, r.readCommitment())
+				if err != nil {
+					log.Printf("Warning: failed to read rent of %s: %v", ata.address, err)
+					report("✅ %s for %s (mint %s) created\n", ata.address, ata.wallet, ata.mint)
+					continue
+				}
+				rentPaid += balance.Value
+				report("✅ %s for %s (mint %s) created, %d lamports rent\n", ata.address, ata.wallet, ata.mint, balance.Value)
+			}
+		}
+	}
+
+	fmt.Printf("\nCreated: %d\n", created)
+	fmt.Printf("Already Existed: %d\n", existing)
+	if failed > 0 {
+		fmt.Printf("Failed: %d\n", failed)
+	}
+	fmt.Printf("Rent Paid: %d lamports\n", rentPaid)
+
+	if failed > 0 {
+		return fmt.Errorf("%d token accounts could not be created", failed)
+	}
+	return nil
+}
+
+// sendATABatch creates batch in a single transaction paid by payer and waits
+// for it to confirm.
+func (r *transferRunner) sendATABatch(ctx context.Context, payer *solana.Account, batch []pendingATA) error {
+	var instructions []solana.Instruction
+	for _, ata := range batch {
+		instructions = append(instructions, createATAInstruction(payer.PublicKey(), ata.address, ata.wallet, ata.mint, ata.program))
+	}
+
+	recentBlockhash, _, err := r.recentBlockhash(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get recent blockhash: %w", err)
+	}
+	budget, err := r.batchComputeBudgetInstructions(ctx, instructions, recentBlockhash, payer.PublicKey(), payer)
+	if err != nil {
+		return err
+	}
+
+	tx, err := solana.NewTransaction(
+		append(budget, instructions...),
+		recentBlockhash,
+		solana.TransactionPayer(payer.PublicKey()),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	if _, err := tx.Sign(signerFor(payer)); err != nil {
+		return fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	if err := checkTransactionSize(tx); err != nil {
+		return err
+	}
+
+	sig, err := r.client.SendTransactionWithOpts(ctx, tx, rpc.TransactionOpts{
+		PreflightCommitment: rpc.CommitmentType(r.config.PreflightCommitment),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send transaction: %w", err)
+	}
+
+	conf, err := r.confirm(ctx, sig, rpc.CommitmentType(r.config.Commitment))
+	if err != nil {
+		return fmt.Errorf("failed to get transaction status of %s: %w", sig, err)
+	}
+	if conf.TxErr != nil {
+		return fmt.Errorf("transaction %s failed: %v", sig, conf.TxErr)
+	}
+	return nil
+}
+
+// partialSignTransfers builds every transfer, signing only with the keys in
+// the config, and prints the partially signed transactions together with
+// the signers still required to complete them. Nothing is sent.
+func (r *transferRunner) partialSignTransfers(ctx context.Context, transfers []TransferInstruction) error {
+	var failed int
+	sponsored := make(map[string]uint64)
+	reimbursed := make(map[string]uint64)
+	for _, transfer := range transfers {
+		result := TransferResult{ID: transfer.ID}
+
+		fmt.Printf("\nTransfer %s:\n", transfer.ID)
+		tx, err := r.buildTransaction(ctx, &transfer, &result)
+		var encoded string
+		if err == nil {
+			encoded, err = tx.ToBase64()
+		}
+		if err != nil {
+			failed++
+			report("   ❌ %v\n", err)
+			continue
+		}
+
+		fmt.Printf("   Transaction (base64): %s\n", encoded)
+		if result.SponsoredFee > 0 {
+			sponsored[result.FromAccount] += result.SponsoredFee
+			if result.SponsoredReimbursed {
+				reimbursed[result.FromAccount] += result.SponsoredFee
+				fmt.Printf("   Sponsored Fee: ~%d lamports, repaid by the sender in this transaction\n", result.SponsoredFee)
+			} else {
+				fmt.Printf("   Sponsored Fee: ~%d lamports, paid by %s\n", result.SponsoredFee, transfer.FeePayer)
+			}
+		}
+		missing := missingSigners(tx)
+		if len(missing) == 0 {
+			fmt.Println("   Missing Signers: none, ready to broadcast")
+			continue
+		}
+		fmt.Println("   Missing Signers:")
+		for _, key := range missing {
+			fmt.Printf("      %s\n", key)
+		}
+	}
+
+	// Cost allocation of sponsored fees per sender
+	if len(sponsored) > 0 {
+		senders := make([]string, 0, len(sponsored))
+		for sender := range sponsored {
+			senders = append(senders, sender)
+		}
+		sort.Strings(senders)
+		fmt.Println("\nSponsored Fees Per Sender:")
+		for _, sender := range senders {
+			fmt.Printf("   %s: ~%d lamports (%d repaid)\n", sender, sponsored[sender], reimbursed[sender])
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d transfers could not be signed", failed)
+	}
+	return nil
+}
+
+// estimateTransfers builds every transfer and prints its estimated fee and
+// the total cost per sender without sending anything.
+func (r *transferRunner) estimateTransfers(ctx context.Context, transfers []TransferInstruction) error {
+	var totalFees, totalAmount uint64
+	perSender := make(map[string]uint64)
+	var failed int
+
+	fmt.Println("\nFee Estimates:")
+	fmt.Println("==============")
+
+	for _, transfer := range transfers {
+		result := TransferResult{ID: transfer.ID}
+
+		tx, err := r.buildTransaction(ctx, &transfer, &result)
+		if err == nil {
+			result.EstimatedFee, err = estimateFee(ctx, r.client, tx, r.readCommitment())
+		}
+		if err != nil {
+			failed++
+			report("❌ Transfer %s: %v\n", transfer.ID, err)
+			continue
+		}
+
+		totalFees += result.EstimatedFee
+		if result.Mint == "" {
+			totalAmount += result.Amount
+		}
+		// Token amounts are not lamports; only the fee is paid in SOL
+		perSender[result.FromAccount] += result.EstimatedFee
+		if result.Mint == "" {
+			perSender[result.FromAccount] += result.Amount
+		}
+		fmt.Printf("Transfer %s: %d lamports + %d lamports fee\n", transfer.ID, result.Amount, result.EstimatedFee)
+	}
+
+	fmt.Printf("\nTotal Amount: %d lamports\n", totalAmount)
+	fmt.Printf("Total Estimated Fees: %d lamports\n", totalFees)
+	fmt.Println("Required Per Sender:")
+	senders := make([]string, 0, len(perSender))
+	for sender := range perSender {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+	for _, sender := range senders {
+		fmt.Printf("   %s: %d lamports\n", sender, perSender[sender])
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d transfers could not be estimated", failed)
+	}
+	return nil
+}
+
+// transferSenders returns the distinct sender addresses of transfers, in
+// order of first use. Keys that do not decode are left to fail in the
+// transfer itself.
+func transferSenders(transfers []TransferInstruction) []solana.PublicKey {
+	seen := make(map[solana.PublicKey]bool)
+	var senders []solana.PublicKey
+	for _, transfer := range transfers {
+		privateKeyBytes, err := base64.StdEncoding.DecodeString(transfer.FromPrivateKey)
+		if err != nil {
+			continue
+		}
+		sender := solana.NewAccountFromPrivateKeyBytes(privateKeyBytes).PublicKey()
+		if !seen[sender] {
+			seen[sender] = true
+			senders = append(senders, sender)
+		}
+	}
+	return senders
+}
+
+// senderBalances reads the SOL balance of every sender.
+func (r *transferRunner) senderBalances(ctx context.Context, senders []solana.PublicKey) (map[string]uint64, error) {
+	balances := make(map[string]uint64, len(senders))
+	for _, sender := range senders {
+		balance, err := r.client.GetBalance(ctx, sender, r.readCommitment())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get balance of %s: %w", sender, err)
+		}
+		balances[sender.String()] = balance.Value
+	}
+	return balances, nil
+}
+
+// reconcileBalances compares how much each sender's balance fell during the
+// run against the SOL it sent in confirmed transfers plus the fees of every
+// transaction that landed, and reports senders that differ by more than the
+// configured tolerance. It returns the number of such senders.
+func (r *transferRunner) reconcileBalances(ctx context.Context, before map[string]uint64, results []TransferResult) int {
+	expected := make(map[string]int64, len(before))
+	unknownFees := make(map[string]int)
+	for _, result := range results {
+		if _, ok := before[result.FromAccount]; !ok || result.Signature == "" {
+			continue
+		}
+		if result.Status == "Confirmed" && result.Mint == "" {
+			expected[result.FromAccount] += int64(result.Amount)
+		}
+
+		// A separate fee payer paid the fee, which the sender may repay
+		if result.SponsoredFee > 0 {
+			if result.SponsoredReimbursed && result.Status == "Confirmed" {
+				expected[result.FromAccount] += int64(result.SponsoredFee)
+			}
+			continue
+		}
+
+		// Transactions that failed on chain still paid their fee
+		fee := result.Fee
+		if fee == 0 {
+			sig, err := solana.SignatureFromBase58(result.Signature)
+			if err == nil {
+				fee, err = actualFee(ctx, r.client, sig)
+			}
+			if err != nil {
+				if result.Status == "Confirmed" {
+					unknownFees[result.FromAccount]++
+				}
+				continue
+			}
+		}
+		expected[result.FromAccount] += int64(fee)
+	}
+
+	senders := make([]string, 0, len(before))
+	for sender := range before {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+
+	fmt.Println("\nBalance Reconciliation:")
+	fmt.Println("=======================")
+	tolerance := int64(r.config.ReconcileToleranceLamports)
+	var mismatches int
+	for _, sender := range senders {
+		balance, err := r.client.GetBalance(ctx, solana.MustPublicKeyFromBase58(sender), r.readCommitment())
+		if err != nil {
+			mismatches++
+			report("⚠️  %s: failed to re-read balance: %v\n", sender, err)
+			continue
+		}
+
+		decrease := int64(before[sender]) - int64(balance.Value)
+		diff := decrease - expected[sender]
+		if diff < 0 {
+			diff = -diff
+		}
+		note := ""
+		if unknownFees[sender] > 0 {
+			note = fmt.Sprintf(" (fee unknown for %d transactions)", unknownFees[sender])
+		}
+		if diff > tolerance {
+			mismatches++
+			report("⚠️  %s: balance fell by %d lamports, expected %d, off by %d%s\n",
+				sender, decrease, expected[sender], diff, note)
+		} else {
+			report("✅ %s: balance fell by %d lamports, expected %d%s\n",
+				sender, decrease, expected[sender], note)
+		}
+	}
+	return mismatches
+}
+
+// confirmationGracePeriod returns how long to wait after sending before the
+// first status poll. Unless configured, it is roughly how long commitment
+// takes to be reached at the earliest.
+func confirmationGracePeriod(config *Config, commitment rpc.CommitmentType) time.Duration {
+	switch {
+	case config.ConfirmationGraceMs < 0:
+		return 0
+	case config.ConfirmationGraceMs > 0:
+		return time.Duration(config.ConfirmationGraceMs) * time.Millisecond
+	}
+
+	switch commitment {
+	case rpc.CommitmentProcessed:
+		return 400 * time.Millisecond
+	case rpc.CommitmentFinalized:
+		// Finality takes ~13s, so polling much earlier is wasted
+		return 8 * time.Second
+	default:
+		return time.Second
+	}
+}
+
+// pollInterval returns how often to poll for commitment: the configured
+// interval, or otherwise one that is short where the commitment is reached
+// quickly and long where it is not, to save requests.
+func pollInterval(config *Config, commitment rpc.CommitmentType) time.Duration {
+	if config.StatusPollIntervalMs > 0 {
+		return time.Duration(config.StatusPollIntervalMs) * time.Millisecond
+	}
+
+	switch commitment {
+	case rpc.CommitmentProcessed:
+		return 250 * time.Millisecond
+	case rpc.CommitmentFinalized:
+		return 2 * time.Second
+	default:
+		return statusPollInterval
+	}
+}
+
+// confirmation is the outcome of waiting for a signature to reach the
+// target commitment.
+type confirmation struct {
+	// Mechanism that observed it: "poll" or "websocket"
+	Via                string
+	ConfirmationStatus string
+	// Non-nil if the transaction landed but failed
+	TxErr interface{}
+}
+
+// confirm waits for sig using the configured confirm_via mechanism.
+func (r *transferRunner) confirm(ctx context.Context, sig solana.Signature, commitment rpc.CommitmentType) (confirmation, error) {
+	switch r.config.ConfirmVia {
+	case "websocket":
+		return r.websocketConfirmation(ctx, sig, commitment)
+	case "race":
+		return r.raceConfirmation(ctx, sig, commitment)
+	default:
+		return r.pollConfirmation(ctx, sig, commitment)
+	}
+}
+
+// pollConfirmation polls getSignatureStatuses until sig reaches commitment
+// or fails.
+func (r *transferRunner) pollConfirmation(ctx context.Context, sig solana.Signature, commitment rpc.CommitmentType) (confirmation, error) {
+	policy := newSuccessPolicy(r.config, commitment)
+
+	// Give the transaction time to propagate before the first poll
+	wait := confirmationGracePeriod(r.config, commitment)
+	for {
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return confirmation{}, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		// Wait a bit before checking again
+		wait = pollInterval(r.config, commitment)
+
+		status, err := getSignatureStatus(ctx, r.client, sig, r.config.SearchTransactionHistory)
+		if err != nil {
+			return confirmation{}, err
+		}
+
+		if status != nil && status.Err != nil {
+			return confirmation{Via: "poll", TxErr: status.Err}, nil
+		}
+		if status != nil && policy.reached(status) {
+			return confirmation{Via: "poll", ConfirmationStatus: string(status.ConfirmationStatus)}, nil
+		}
+	}
+}
+
+// websocketConfirmation waits for a signatureSubscribe notification for sig
+// at commitment over the shared websocket connection.
+func (r *transferRunner) websocketConfirmation(ctx context.Context, sig solana.Signature, commitment rpc.CommitmentType) (confirmation, error) {
+	wsClient, err := r.websocket(ctx)
+	if err != nil {
+		return confirmation{}, err
+	}
+
+	sub, err := wsClient.SignatureSubscribe(sig, commitment)
+	if err != nil {
+		return confirmation{}, fmt.Errorf("failed to subscribe to signature: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	// Recv does not take a context, so unblock it by unsubscribing on cancel
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Unsubscribe()
+		case <-done:
+		}
+	}()
+
+	notification, err := sub.Recv()
+	if err == nil && notification == nil {
+		// Unsubscribing ends Recv with neither a notification nor an error
+		err = errors.New("subscription closed")
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return confirmation{}, ctx.Err()
+		}
+		return confirmation{}, fmt.Errorf("signature subscription failed: %w", err)
+	}
+
+	// Notifications carry no confirmation count; polling waits for it
+	if r.config.MinConfirmations > 0 && notification.Value.Err == nil {
+		conf, err := r.pollConfirmation(ctx, sig, commitment)
+		conf.Via = "websocket"
+		return conf, err
+	}
+
+	return confirmation{
+		Via:                "websocket",
+		ConfirmationStatus: string(commitment),
+		TxErr:              notification.Value.Err,
+	}, nil
+}
+
+// raceConfirmation runs polling and the websocket subscription side by side
+// and takes whichever confirms first, so a stalled mechanism cannot hold the
+// transfer up. If one mechanism errors, the other one still decides.
+func (r *transferRunner) raceConfirmation(ctx context.Context, sig solana.Signature, commitment rpc.CommitmentType) (confirmation, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		conf confirmation
+		err  error
+	}
+	outcomes := make(chan outcome, 2)
+
+	go func() {
+		conf, err := r.pollConfirmation(ctx, sig, commitment)
+		outcomes <- outcome{conf, err}
+	}()
+	go func() {
+		conf, err := r.websocketConfirmation(ctx, sig, commitment)
+		outcomes <- outcome{conf, err}
+	}()
+
+	first := <-outcomes
+	if first.err == nil {
+		return first.conf, nil
+	}
+	second := <-outcomes
+	return second.conf, second.err
+}
+
+// websocket returns the run's shared websocket connection, connecting on
+// first use.
+func (r *transferRunner) websocket(ctx context.Context) (*ws.Client, error) {
+	r.wsMu.Lock()
+	defer r.wsMu.Unlock()
+
+	if r.wsClient != nil {
+		return r.wsClient, nil
+	}
+
+	// The connection outlives any single transfer's context
+	wsClient, err := ws.Connect(context.Background(), r.config.WebsocketURL())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", r.config.WebsocketURL(), err)
+	}
+	r.wsClient = wsClient
+	return wsClient, nil
+}
+
+// Close releases the shared websocket connection, if one was opened.
+func (r *transferRunner) Close() {
+	r.wsMu.Lock()
+	defer r.wsMu.Unlock()
+
+	if r.wsClient != nil {
+		r.wsClient.Close()
+		r.wsClient = nil
+	}
+}
+
+// runPool sends transfers with a fixed pool of workers pulling them off a
+// channel, so at most workers are in flight, and returns once all are
+// handed out. The returned WaitGroup is done when the workers are; each
+// transfer is also added to wg, which executeTransfer marks done.
+func (r *transferRunner) runPool(ctx context.Context, transfers []TransferInstruction, workers int, wg *sync.WaitGroup, results chan<- TransferResult) *sync.WaitGroup {
+	if workers > len(transfers) {
+		workers = len(transfers)
+	}
+
+	jobs := make(chan TransferInstruction)
+	var pool sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		pool.Add(1)
+		go func() {
+			defer pool.Done()
+			for transfer := range jobs {
+				r.executeTransfer(ctx, transfer, wg, results)
+			}
+		}()
+	}
+	for _, transfer := range transfers {
+		wg.Add(1)
+		jobs <- transfer
+	}
+	close(jobs)
+
+	return &pool
+}
+
+// Options configures a BulkTransferrer.
+type Options struct {
+	// Settings of config.yaml; its transfers are ignored in favour of those
+	// passed to Run
+	Config *Config
+	// Transfers in flight at once, overriding max_concurrency
+	Concurrency int
+	// Failover and rate limiter statistics of the client, from NewRPCClient
+	Endpoints *Endpoints
+	// Return each transfer as Submitted once sent and leave confirmation to
+	// ConfirmSubmitted; requires state_file
+	SubmitOnly bool
+	// Also insert every result into this SQLite database
+	SQLitePath string
+	// Where progress messages go; nil discards them
+	Progress io.Writer
+	// Called with every final result as it arrives, from Run's goroutine
+	OnResult func(TransferResult)
+	// Called with every failure deferred to retry round round
+	OnDeferred func(result TransferResult, round int)
+}
+
+// BulkTransferrer sends transfers like the CLI does and returns the results
+// instead of printing them, for use from other Go code. Report, Finalize and
+// the Write methods cover what the CLI does with the results of a Run.
+type BulkTransferrer struct {
+	client      *rpc.Client
+	endpoints   *Endpoints
+	config      *Config
+	opts        Options
+	concurrency int
+
+	// What the last Run found beyond its results
+	last *runOutcome
+}
+
+// runOutcome is what a run sets up and learns besides its results.
+type runOutcome struct {
+	config *Config
+	runner *transferRunner
+	cancel context.CancelFunc
+
+	// Transfers dispatched, without those the state file has as done
+	transfers []TransferInstruction
+	// Transfers the state file has as done, with why, and their reasons
+	// counted
+	stateSkipped map[string]string
+	skipReasons  map[string]int
+	splitParts   map[string][]string
+	// Transfers whose result never arrived because collection ended early
+	noResult []string
+
+	balancesBefore map[string]uint64
+	startTime      time.Time
+	totalTime      time.Duration
+}
+
+// close stops the run's background work and closes its connections.
+func (o *runOutcome) close() {
+	o.cancel()
+	o.runner.Close()
+	if o.runner.state != nil {
+		o.runner.state.Close()
+		o.runner.state = nil
+	}
+}
+
+// New returns a BulkTransferrer sending through client. A nil client is
+// created from the config by NewRPCClient when Run starts.
+func New(client *rpc.Client, opts Options) *BulkTransferrer {
+	config := opts.Config
+	if config == nil {
+		config = &Config{}
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = config.MaxConcurrency
+	}
+	if concurrency <= 0 {
+		concurrency = defaultMaxConcurrency
+	}
+	return &BulkTransferrer{
+		client:      client,
+		endpoints:   opts.Endpoints,
+		config:      config,
+		opts:        opts,
+		concurrency: concurrency,
+	}
+}
+
+// printf writes a progress message to Options.Progress, if set.
+func (b *BulkTransferrer) printf(format string, a ...interface{}) {
+	printTo(b.opts.Progress, format, a...)
+}
+
+// prepare resolves transfers against the config and sets up the runner
+// that sends them: keys, splits, the blockhash cache, fee payers and the
+// state file, whose done transfers are left out. Percent amounts are fixed
+// against the balances at this point, after the canary when sending. The
+// caller closes the outcome.
+func (b *BulkTransferrer) prepare(ctx context.Context, transfers []TransferInstruction, sending bool) (*runOutcome, error) {
+	config := *b.config
+	config.Transfers = append([]TransferInstruction(nil), transfers...)
+	for i := range config.Transfers {
+		if config.Transfers[i].ID == "" {
+			config.Transfers[i].ID = strconv.Itoa(i)
+		}
+	}
+	if err := normalizeKeys(&config); err != nil {
+		return nil, err
+	}
+	if err := resolveDerivedKeys(&config, b.opts.Progress); err != nil {
+		return nil, err
+	}
+	if err := ValidateTransfers(&config); err != nil {
+		return nil, err
+	}
+
+	// Large transfers split into several transactions
+	var splitParts map[string][]string
+	config.Transfers, splitParts = splitTransfers(config.Transfers)
+	if len(splitParts) > 0 {
+		b.printf("Split %d transfers into parts, %d transactions in total\n", len(splitParts), len(config.Transfers))
+	}
+
+	if b.client == nil {
+		client, endpoints, err := NewRPCClient(&config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create RPC client: %w", err)
+		}
+		b.client, b.endpoints = client, endpoints
+	}
+
+	// Fail fast instead of sending a whole run into a dead node
+	if config.SlotCheckWindowMs > 0 {
+		if err := checkSlotProgress(ctx, b.client, time.Duration(config.SlotCheckWindowMs)*time.Millisecond); err != nil {
+			return nil, fmt.Errorf("slot check failed: %w", err)
+		}
+	}
+
+	// The cache refreshes in the background until the run is closed
+	ctx, cancel := context.WithCancel(ctx)
+	blockhashes, err := startBlockhashCache(ctx, b.client, &config)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start blockhash cache: %w", err)
+	}
+
+	run := &runOutcome{
+		config: &config,
+		cancel: cancel,
+		runner: &transferRunner{
+			client:   b.client,
+			config:   &config,
+			oracle:   newPriceOracle(&config),
+			runID:    newRunID(),
+			progress: b.opts.Progress,
+
+			blockhashes: blockhashes,
+			broadcast:   newBroadcastClients(&config),
+		},
+		transfers:    config.Transfers,
+		stateSkipped: make(map[string]string),
+		skipReasons:  make(map[string]int),
+		splitParts:   splitParts,
+	}
+	runner := run.runner
+	if config.LatencyThresholdMs > 0 {
+		runner.latency = newLatencyThrottle(&config)
+	}
+	if len(config.FeePayerKeys) > 0 {
+		runner.payers, err = newFeePayerPool(ctx, b.client, &config)
+		if err != nil {
+			run.close()
+			return nil, fmt.Errorf("failed to load fee payers: %w", err)
+		}
+	}
+
+	// Skip transfers the state file says were already sent
+	if config.StateFile != "" {
+		records, err := loadState(config.StateFile)
+		if err != nil {
+			run.close()
+			return nil, fmt.Errorf("failed to load state: %w", err)
+		}
+
+		run.transfers = nil
+		for _, transfer := range config.Transfers {
+			record, ok := records[transfer.ID]
+			if skip, reason, detail := shouldSkip(record, ok); skip {
+				b.printf("Skipping transfer %s: %s\n", transfer.ID, detail)
+				run.skipReasons[reason]++
+				run.stateSkipped[transfer.ID] = detail
+				continue
+			}
+			run.transfers = append(run.transfers, transfer)
+		}
+
+		runner.state, err = openStateFile(config.StateFile)
+		if err != nil {
+			run.close()
+			return nil, fmt.Errorf("failed to open state: %w", err)
+		}
+	}
+
+	// Prove the live path with one small transfer before risking the batch,
+	// and before reading the balances it changes
+	if sending && config.Canary != nil && len(run.transfers) > 0 {
+		if err := runner.runCanary(ctx, config.Canary, run.transfers[0].FromPrivateKey); err != nil {
+			run.close()
+			return nil, fmt.Errorf("canary transfer failed, nothing else was sent: %w", err)
+		}
+	}
+
+	// Fix percent amounts against the balances at the start of the run
+	if err := runner.resolvePercentAmounts(ctx, run.transfers); err != nil {
+		run.close()
+		return nil, fmt.Errorf("failed to resolve percent amounts: %w", err)
+	}
+	return run, nil
+}
+
+// inspect prepares transfers like Run and hands the runner and the
+// transfers it would send to fn instead of sending them.
+func (b *BulkTransferrer) inspect(ctx context.Context, transfers []TransferInstruction, fn func(*transferRunner, []TransferInstruction) error) error {
+	run, err := b.prepare(ctx, transfers, false)
+	if err != nil {
+		return err
+	}
+	defer run.close()
+	return fn(run.runner, run.transfers)
+}
+
+// Estimate prints the fees and balances transfers need, without sending.
+func (b *BulkTransferrer) Estimate(ctx context.Context, transfers []TransferInstruction) error {
+	return b.inspect(ctx, transfers, func(runner *transferRunner, transfers []TransferInstruction) error {
+		return runner.estimateTransfers(ctx, transfers)
+	})
+}
+
+// Explain prints a decoded view of every transaction, without sending.
+func (b *BulkTransferrer) Explain(ctx context.Context, transfers []TransferInstruction) error {
+	return b.inspect(ctx, transfers, func(runner *transferRunner, transfers []TransferInstruction) error {
+		return runner.explainTransfers(ctx, transfers)
+	})
+}
+
+// PartialSign signs every transaction with the available keys only and
+// prints it with its missing signers, without sending.
+func (b *BulkTransferrer) PartialSign(ctx context.Context, transfers []TransferInstruction) error {
+	return b.inspect(ctx, transfers, func(runner *transferRunner, transfers []TransferInstruction) error {
+		runner.partialSign = true
+		return runner.partialSignTransfers(ctx, transfers)
+	})
+}
+
+// CreateATAs creates the missing associated token accounts of token
+// transfer recipients, without transferring.
+func (b *BulkTransferrer) CreateATAs(ctx context.Context, transfers []TransferInstruction) error {
+	return b.inspect(ctx, transfers, func(runner *transferRunner, transfers []TransferInstruction) error {
+		return runner.createATAs(ctx, transfers)
+	})
+}
+
+// Run validates and sends transfers and returns their results in the order
+// given, split transfers as one result per part. Transfers without an id get
+// their index. Transfers the state file has as done are returned as Skipped
+// without being sent; failures that never reached the network are retried
+// in up to retry_rounds later rounds. A transfer whose result never arrived
+// is left out, see Report. The error is for problems that stop the whole
+// run, such as invalid transfers or a failed canary; failures of single
+// transfers are in their results.
+func (b *BulkTransferrer) Run(ctx context.Context, transfers []TransferInstruction) ([]TransferResult, error) {
+	if b.opts.SubmitOnly && b.config.StateFile == "" {
+		return nil, errors.New("submit-only requires state_file")
+	}
+
+	run, err := b.prepare(ctx, transfers, true)
+	if err != nil {
+		return nil, err
+	}
+	defer run.close()
+	b.last = run
+	config, runner := run.config, run.runner
+	runner.submitOnly = b.opts.SubmitOnly
+	pending := run.transfers
+
+	// Sign now, broadcast at the target slot
+	if config.SendAtSlot > 0 {
+		runner.presignTransfers(ctx, pending)
+		b.printf("Waiting for slot %d before sending...\n", config.SendAtSlot)
+		if err := waitForSlot(ctx, b.client, config.SendAtSlot); err != nil {
+			return nil, fmt.Errorf("failed waiting for slot: %w", err)
+		}
+	}
+
+	var sink *sqliteSink
+	if b.opts.SQLitePath != "" {
+		sink, err = openSQLiteSink(b.opts.SQLitePath, runner.runID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open SQLite sink: %w", err)
+		}
+		defer sink.Close()
+	}
+
+	// Hide the list order from on-chain timing
+	if config.Shuffle {
+		seed := config.ShuffleSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		pending = shuffleTransfers(pending, seed)
+		b.printf("Shuffled dispatch order (seed %d)\n", seed)
+	}
+
+	// Snapshot sender balances to reconcile against after the run
+	if config.ReconcileBalances {
+		run.balancesBefore, err = runner.senderBalances(ctx, transferSenders(pending))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sender balances: %w", err)
+		}
+	}
+
+	run.startTime = time.Now()
+
+	// Limit the number of transfers in flight
+	concurrency := b.concurrency
+	if concurrency > len(pending) {
+		concurrency = len(pending)
+	}
+	concurrency = checkConcurrency(config, concurrency)
+
+	b.printf("Starting bulk transfer of %d transactions (run %s)...\n", len(pending), runner.runID)
+
+	chunkSize := config.ChunkSize
+	if chunkSize <= 0 || chunkSize > len(pending) {
+		chunkSize = len(pending)
+	}
+	chunkDelay := time.Duration(config.ChunkDelaySeconds) * time.Second
+	if chunkSize < len(pending) {
+		b.printf("Sending in chunks of %d with %v between chunks\n", chunkSize, chunkDelay)
+		if config.StateFile == "" {
+			log.Printf("Warning: no state_file configured, completed chunks will not be skipped if the run is restarted")
+		}
+	}
+
+	// Report transfers that appear stuck while the run is in progress
+	if config.StuckTransferSeconds >= 0 {
+		threshold := time.Duration(config.StuckTransferSeconds) * time.Second
+		if threshold == 0 {
+			threshold = 60 * time.Second
+		}
+		interval := threshold
+		if interval > 10*time.Second {
+			interval = 10 * time.Second
+		}
+		watchdogCtx, stopWatchdog := context.WithCancel(ctx)
+		defer stopWatchdog()
+		go runner.watchStuckTransfers(watchdogCtx, threshold, interval)
+	}
+
+	// dispatch executes transfers in parallel, one chunk at a time, and
+	// returns the channel their results are collected from
+	dispatch := func(transfers []TransferInstruction) <-chan TransferResult {
+		var wg sync.WaitGroup
+		bufferSize := config.ResultBufferSize
+		if bufferSize <= 0 {
+			bufferSize = len(transfers)
+			if bufferSize > defaultResultBuffer {
+				bufferSize = defaultResultBuffer
+			}
+		}
+		results := make(chan TransferResult, bufferSize)
+
+		go func() {
+			defer func() {
+				wg.Wait()
+				close(results)
+			}()
+
+			for start := 0; start < len(transfers); start += chunkSize {
+				end := start + chunkSize
+				if end > len(transfers) {
+					end = len(transfers)
+				}
+
+				chunk := runner.runPool(ctx, transfers[start:end], concurrency, &wg, results)
+
+				if end == len(transfers) {
+					return
+				}
+
+				// Checkpoint: every transfer in the chunk is settled and recorded
+				chunk.Wait()
+				log.Printf("Chunk %d-%d of %d done, pausing %v", start, end-1, len(transfers), chunkDelay)
+				select {
+				case <-ctx.Done():
+					// The remaining transfers report themselves as cancelled
+				case <-time.After(chunkDelay):
+				}
+			}
+		}()
+
+		return results
+	}
+
+	// On-failure hooks run alongside collection; wait for them before returning
+	var hooks sync.WaitGroup
+	hookTimeout := time.Duration(config.OnFailureTimeoutSeconds) * time.Second
+	if hookTimeout <= 0 {
+		hookTimeout = 30 * time.Second
+	}
+	byID := make(map[string]TransferResult, len(config.Transfers))
+	handle := func(result TransferResult, deferred bool) {
+		if sink != nil {
+			if err := sink.Insert(result); err != nil {
+				log.Printf("Warning: failed to write transfer %s to SQLite: %v", result.ID, err)
+			}
+		}
+		if deferred {
+			return
+		}
+		byID[result.ID] = result
+		if config.OnFailureCommand != "" && resultOutcome(result) == "failed" {
+			hooks.Add(1)
+			go func(result TransferResult) {
+				defer hooks.Done()
+				runFailureHook(ctx, config.OnFailureCommand, hookTimeout, result)
+			}(result)
+		}
+		if b.opts.OnResult != nil {
+			b.opts.OnResult(result)
+		}
+	}
+
+	// Failures that never reached the network are retried in later rounds
+	transfersByID := make(map[string]TransferInstruction, len(pending))
+	for _, transfer := range pending {
+		transfersByID[transfer.ID] = transfer
+	}
+	retryDelay := time.Duration(config.RetryRoundDelaySeconds) * time.Second
+	if retryDelay <= 0 {
+		retryDelay = 10 * time.Second
+	}
+	for round := 0; len(pending) > 0; round++ {
+		if round > 0 {
+			b.printf("\nRetry round %d of %d: %d transfers in %v\n\n", round, config.RetryRounds, len(pending), retryDelay)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryDelay):
+			}
+		}
+
+		deferrable := func(result TransferResult) bool {
+			return round < config.RetryRounds && isRetryable(result) && ctx.Err() == nil
+		}
+		roundCounts := make(map[string]int)
+		deferred, missing := collectRound(dispatch(pending), pending, deferrable, func(result TransferResult, deferred bool) {
+			handle(result, deferred)
+			if deferred {
+				roundCounts["deferred"]++
+				if b.opts.OnDeferred != nil {
+					b.opts.OnDeferred(result, round+1)
+				}
+				return
+			}
+			roundCounts[strings.ToLower(newResultRecord(result).Status)]++
+		})
+
+		if config.RetryRounds > 0 {
+			b.printf("Round %d: %s\n", round, formatCounts(roundCounts))
+		}
+		if len(missing) > 0 {
+			log.Printf("Warning: results closed early, %d transfers of round %d produced no result", len(missing), round)
+			run.noResult = append(run.noResult, missing...)
+		}
+
+		pending = make([]TransferInstruction, len(deferred))
+		for i, result := range deferred {
+			pending[i] = transfersByID[result.ID]
+		}
+	}
+	hooks.Wait()
+	run.totalTime = time.Since(run.startTime)
+
+	// Results in list order whatever order they were dispatched and finished in
+	ordered := make([]TransferResult, 0, len(config.Transfers))
+	for _, transfer := range config.Transfers {
+		if detail, ok := run.stateSkipped[transfer.ID]; ok {
+			ordered = append(ordered, TransferResult{
+				ID:         transfer.ID,
+				ToAccount:  transfer.ToAddress,
+				Mint:       transfer.Mint,
+				Amount:     transfer.Amount,
+				Status:     "Skipped",
+				SkipReason: detail,
+			})
+			continue
+		}
+		if result, ok := byID[transfer.ID]; ok {
+			ordered = append(ordered, result)
+		}
+	}
+	return ordered, nil
+}
+
+// collectRound gathers the results of one round of pending transfers until
+// results is closed, handing each to handle along with whether deferrable
+// defers it to the next round. It returns the deferred results and the ids
+// of pending transfers whose result never arrived, in dispatch order.
+func collectRound(results <-chan TransferResult, pending []TransferInstruction, deferrable func(TransferResult) bool, handle func(result TransferResult, deferred bool)) ([]TransferResult, []string) {
+	var deferred []TransferResult
+	answered := make(map[string]bool, len(pending))
+	for result := range results {
+		if answered[result.ID] {
+			log.Printf("Warning: ignoring a second result for transfer %s", result.ID)
+			continue
+		}
+		answered[result.ID] = true
+
+		if deferrable(result) {
+			deferred = append(deferred, result)
+			handle(result, true)
+			continue
+		}
+		handle(result, false)
+	}
+	return deferred, missingResults(pending, answered)
+}
+
+// resultOutcome sorts a final result into the category the report counts
+// it under: successful, failed, submitted, unconfirmed, cancelled or
+// skipped.
+func resultOutcome(result TransferResult) string {
+	switch {
+	case result.Status == "Cancelled":
+		// Interrupted by shutdown, not a real failure
+		return "cancelled"
+	case result.Status == "Unconfirmed" || result.Status == "Timeout":
+		return "unconfirmed"
+	case result.Status == "Skipped":
+		return "skipped"
+	case result.Status == "Submitted":
+		return "submitted"
+	case result.Error != nil:
+		return "failed"
+	default:
+		return "successful"
+	}
+}
+
+// Reporter prints results as they arrive the way the CLI does. Its Result
+// and Deferred methods fit Options.OnResult and Options.OnDeferred.
+type Reporter struct {
+	// Print only failed, cancelled and unconfirmed transfers
+	FailuresOnly bool
+
+	header sync.Once
+}
+
+func (r *Reporter) printHeader() {
+	r.header.Do(func() {
+		fmt.Println("\nTransaction Results:")
+		fmt.Println("====================")
+	})
+}
+
+// Result prints a final result.
+func (r *Reporter) Result(result TransferResult) {
+	r.printHeader()
+	switch resultOutcome(result) {
+	case "cancelled":
+		report("⏹ From: %s\n   To: %s\n   Amount: %d lamports\n   Cancelled: %v\n",
+			result.FromAccount, result.ToAccount, result.Amount, result.Error)
+		if result.Signature != "" {
+			fmt.Printf("   Signature: %s (submitted, outcome unknown)\n", result.Signature)
+		}
+		fmt.Println()
+	case "unconfirmed":
+		report("⏳ From: %s\n   To: %s\n   Amount: %d lamports\n   Signature: %s (outcome unknown, check before resending)\n   Error: %v\n\n",
+			result.FromAccount, result.ToAccount, result.Amount, result.Signature, result.Error)
+	case "skipped":
+		if !r.FailuresOnly {
+			report("⏭ Transfer %s skipped: %s\n\n", result.ID, result.SkipReason)
+		}
+	case "submitted":
+		if !r.FailuresOnly {
+			report("📤 From: %s\n   To: %s\n   Amount: %d lamports\n   Signature: %s (confirming in background)\n\n",
+				result.FromAccount, result.ToAccount, result.Amount, result.Signature)
+		}
+	case "failed":
+		report("❌ From: %s\n   To: %s\n   Amount: %d lamports\n   Status: %s\n   Error: %v\n\n",
+			result.FromAccount, result.ToAccount, result.Amount, newResultRecord(result).Status, result.Error)
+	default:
+		if r.FailuresOnly {
+			return
+		}
+		report("✅ From: %s\n   To: %s\n   Amount: %d lamports\n   Signature: %s\n   Processing Time: %v (blockhash %v, send %v, confirm %v)\n",
+			result.FromAccount, result.ToAccount, result.Amount, result.Signature, result.ProcessingTime,
+			result.BlockhashTime, result.SendTime, result.ConfirmTime)
+		if result.ExplorerURL != "" {
+			fmt.Printf("   Explorer: %s\n", result.ExplorerURL)
+		}
+		if result.senderBalanceRead {
+			fmt.Printf("   Sender Balance: %d lamports\n", result.SenderBalanceAfter)
+		}
+		if result.computeUnitsRead {
+			fmt.Printf("   Compute Units: %d\n", result.ComputeUnits)
+		}
+		fmt.Println()
+	}
+}
+
+// Deferred prints a failure deferred to retry round round.
+func (r *Reporter) Deferred(result TransferResult, round int) {
+	r.printHeader()
+	report("↻ Transfer %s deferred to retry round %d: %v\n\n", result.ID, round, result.Error)
+}
+
+// Summary counts how the transfers of a run ended.
+type Summary struct {
+	// Transfers dispatched, without those the state file has as done
+	Transfers int
+
+	Successful  int
+	Failed      int
+	Submitted   int
+	Unconfirmed int
+	Cancelled   int
+	Skipped     int
+	FailReasons map[string]int
+	SkipReasons map[string]int
+
+	// Transfers whose result never arrived because the run was truncated
+	NoResult []string
+	// Senders whose balances do not match the transfers sent, with
+	// reconcile_balances
+	BalanceMismatches int
+	// Failures beyond what min_success_rate tolerates; any failure without it
+	BelowSuccessRate bool
+}
+
+// Add adds the counts of another batch to s. The batches together are below
+// the success rate if any one of them is.
+func (s *Summary) Add(batch Summary) {
+	s.Transfers += batch.Transfers
+	s.Successful += batch.Successful
+	s.Failed += batch.Failed
+	s.Submitted += batch.Submitted
+	s.Unconfirmed += batch.Unconfirmed
+	s.Cancelled += batch.Cancelled
+	s.Skipped += batch.Skipped
+	if s.FailReasons == nil {
+		s.FailReasons = make(map[string]int)
+	}
+	for reason, count := range batch.FailReasons {
+		s.FailReasons[reason] += count
+	}
+	if s.SkipReasons == nil {
+		s.SkipReasons = make(map[string]int)
+	}
+	for reason, count := range batch.SkipReasons {
+		s.SkipReasons[reason] += count
+	}
+	s.NoResult = append(s.NoResult, batch.NoResult...)
+	s.BalanceMismatches += batch.BalanceMismatches
+	s.BelowSuccessRate = s.BelowSuccessRate || batch.BelowSuccessRate
+}
+
+// dispatched returns the results of the last Run without the transfers the
+// state file had as done.
+func (b *BulkTransferrer) dispatched(results []TransferResult) []TransferResult {
+	sent := make([]TransferResult, 0, len(results))
+	for _, result := range results {
+		if _, ok := b.last.stateSkipped[result.ID]; !ok {
+			sent = append(sent, result)
+		}
+	}
+	return sent
+}
+
+// phases returns the time breakdown of the last Run, if report_phases is set.
+func (b *BulkTransferrer) phases(results []TransferResult) *phaseTimes {
+	run := b.last
+	if !run.config.ReportPhases {
+		return nil
+	}
+	var limiter, sendLimiter *rateLimiter
+	if b.endpoints != nil {
+		limiter = b.endpoints.limiter
+	}
+	if run.runner.latency != nil {
+		sendLimiter = run.runner.latency.limiter
+	}
+	return newPhaseTimes(run.totalTime, b.dispatched(results), limiter, sendLimiter)
+}
+
+// Report prints the statistics of the last Run over its results, the way
+// the CLI ends a run, and returns the counts they are based on. With
+// reconcile_balances it also checks the senders' balances against them.
+func (b *BulkTransferrer) Report(ctx context.Context, results []TransferResult) Summary {
+	run := b.last
+	config := run.config
+	sent := b.dispatched(results)
+
+	summary := Summary{
+		Transfers:   len(run.transfers),
+		Skipped:     len(run.stateSkipped),
+		FailReasons: make(map[string]int),
+		SkipReasons: make(map[string]int),
+		NoResult:    run.noResult,
+	}
+	for reason, count := range run.skipReasons {
+		summary.SkipReasons[reason] = count
+	}
+
+	var totalProcessingTime, minTime, maxTime time.Duration
+	var estimatedFees, actualFees uint64
+	var confirmLatencies []time.Duration
+	for i, result := range sent {
+		if i == 0 || result.ProcessingTime < minTime {
+			minTime = result.ProcessingTime
+		}
+		if result.ProcessingTime > maxTime {
+			maxTime = result.ProcessingTime
+		}
+		totalProcessingTime += result.ProcessingTime
+		estimatedFees += result.EstimatedFee
+		actualFees += result.Fee
+
+		// Confirmation alone, from send until the commitment was reached
+		if result.Status == "Confirmed" {
+			confirmLatencies = append(confirmLatencies, result.ConfirmTime)
+		}
+
+		switch resultOutcome(result) {
+		case "cancelled":
+			summary.Cancelled++
+		case "unconfirmed":
+			summary.Unconfirmed++
+		case "skipped":
+			summary.Skipped++
+			summary.SkipReasons["condition not met"]++
+		case "submitted":
+			summary.Submitted++
+		case "failed":
+			summary.Failed++
+			summary.FailReasons[newResultRecord(result).Status]++
+		default:
+			summary.Successful++
+		}
+	}
+	var avgProcessingTime time.Duration
+	if len(sent) > 0 {
+		avgProcessingTime = totalProcessingTime / time.Duration(len(sent))
+	}
+
+	fmt.Println("\nTransaction Statistics:")
+	fmt.Println("======================")
+	fmt.Printf("Total Transactions: %d\n", summary.Transfers)
+	fmt.Printf("Successful: %d\n", summary.Successful)
+	if summary.Failed > 0 && summary.FailReasons["Failed"] != summary.Failed {
+		fmt.Printf("Failed: %d (%s)\n", summary.Failed, formatCounts(summary.FailReasons))
+	} else {
+		fmt.Printf("Failed: %d\n", summary.Failed)
+	}
+	if summary.Submitted > 0 {
+		fmt.Printf("Submitted: %d\n", summary.Submitted)
+	}
+	if summary.Unconfirmed > 0 {
+		fmt.Printf("Unconfirmed: %d\n", summary.Unconfirmed)
+	}
+	if summary.Cancelled > 0 {
+		fmt.Printf("Cancelled: %d\n", summary.Cancelled)
+	}
+	if len(summary.NoResult) > 0 {
+		fmt.Printf("No Result: %d (run truncated, outcome unknown: %s)\n", len(summary.NoResult), formatIDs(summary.NoResult, 10))
+	}
+	if summary.Skipped > 0 {
+		fmt.Printf("Skipped: %d (%s)\n", summary.Skipped, formatCounts(summary.SkipReasons))
+	}
+	// Against a success rate, some failures are tolerable
+	summary.BelowSuccessRate = summary.Failed > 0
+	if config.MinSuccessRate > 0 {
+		rate := 100.0
+		if attempted := summary.Successful + summary.Failed + summary.Unconfirmed; attempted > 0 {
+			rate = float64(summary.Successful) / float64(attempted) * 100
+		}
+		summary.BelowSuccessRate = rate < config.MinSuccessRate
+		fmt.Printf("Success Rate: %.2f%% (minimum %.2f%%)\n", rate, config.MinSuccessRate)
+	}
+	fmt.Printf("Total Time: %v\n", run.totalTime)
+	fmt.Printf("Minimum Processing Time: %v\n", minTime)
+	fmt.Printf("Maximum Processing Time: %v\n", maxTime)
+	fmt.Printf("Average Processing Time: %v\n", avgProcessingTime)
+
+	if len(confirmLatencies) > 0 {
+		sort.Slice(confirmLatencies, func(i, j int) bool { return confirmLatencies[i] < confirmLatencies[j] })
+		fmt.Printf("Confirmation Latency: p50 %v, p90 %v, p99 %v, max %v\n",
+			percentile(confirmLatencies, 50), percentile(confirmLatencies, 90),
+			percentile(confirmLatencies, 99), confirmLatencies[len(confirmLatencies)-1])
+	}
+	if config.EstimateFees {
+		fmt.Printf("Estimated Fees: %d lamports\n", estimatedFees)
+	}
+	if config.VerifyFees {
+		fmt.Printf("Actual Fees: %d lamports\n", actualFees)
+	}
+	if config.ReportComputeUnits {
+		printComputeUnits(sent)
+	}
+	if phases := b.phases(results); phases != nil {
+		phases.print()
+	}
+	printAssetTotals(sent)
+	if len(run.splitParts) > 0 {
+		printSplitSummary(run.splitParts, sent)
+	}
+	if b.endpoints != nil && b.endpoints.failover != nil {
+		b.endpoints.failover.printEndpointStats()
+	}
+	if b.endpoints != nil && b.endpoints.limiter != nil {
+		b.endpoints.limiter.printStats()
+	}
+	if run.runner.latency != nil {
+		run.runner.latency.limiter.printStats()
+	}
+	if run.runner.payers != nil {
+		run.runner.payers.printStats(ctx, b.client)
+	}
+
+	// An accounting difference fails the run like a failed transfer
+	if run.balancesBefore != nil {
+		summary.BalanceMismatches = run.runner.reconcileBalances(ctx, run.balancesBefore, sent)
+		if summary.BalanceMismatches > 0 {
+			log.Printf("Warning: %d senders' balances do not match the transfers sent", summary.BalanceMismatches)
+		}
+	}
+	return summary
+}
+
+// Finalize waits up to finalize_timeout_seconds for the confirmed results
+// of the last Run to be finalized, recording each in the state file, and
+// returns how many were not in time.
+func (b *BulkTransferrer) Finalize(ctx context.Context, results []TransferResult) (int, error) {
+	run := b.last
+	timeout := time.Duration(run.config.FinalizeTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 90 * time.Second
+	}
+	if run.config.StateFile != "" {
+		state, err := openStateFile(run.config.StateFile)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open state: %w", err)
+		}
+		run.runner.state = state
+		defer func() {
+			state.Close()
+			run.runner.state = nil
+		}()
+	}
+	return run.runner.finalizeResults(ctx, run.transfers, results, timeout), nil
+}
+
+// WriteManifest writes the manifest of the last Run, naming outputPath as
+// where its results were written, to path.
+func (b *BulkTransferrer) WriteManifest(path, outputPath string, results []TransferResult) error {
+	run := b.last
+	manifest, err := newRunManifest(run.config, run.runner.runID)
+	if err != nil {
+		return err
+	}
+	manifest.StartedAt = run.startTime.UTC()
+	manifest.FinishedAt = time.Now().UTC()
+	manifest.SQLite = b.opts.SQLitePath
+	manifest.Output = outputPath
+	manifest.Phases = b.phases(results)
+	manifest.StatusCount = make(map[string]int)
+	for _, result := range results {
+		manifest.StatusCount[newResultRecord(result).Status]++
+	}
+	if len(run.noResult) > 0 {
+		manifest.StatusCount["NoResult"] = len(run.noResult)
+	}
+	return manifest.Write(path)
+}
+
+// WriteRetryConfig writes a config repeating the last Run's settings with
+// only its transfers that did not confirm to path; see writeRetryConfig.
+func (b *BulkTransferrer) WriteRetryConfig(path string, results []TransferResult) (int, int, error) {
+	return writeRetryConfig(path, b.last.config, b.last.transfers, results)
+}
+
+// finalizeResults polls confirmed transfers until they are finalized or the
+// timeout passes, appending a Finalized record to the state file for each.
+// It returns the number of transfers that did not finalize in time.
+func (r *transferRunner) finalizeResults(ctx context.Context, transfers []TransferInstruction, results []TransferResult, timeout time.Duration) int {
+	byID := make(map[string]TransferInstruction, len(transfers))
+	for _, transfer := range transfers {
+		byID[transfer.ID] = transfer
+	}
+
+	var pending []int
+	for i, result := range results {
+		if result.Status == "Confirmed" && result.ConfirmationStatus != string(rpc.ConfirmationStatusFinalized) {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return 0
+	}
+
+	total := len(pending)
+	fmt.Printf("\nWaiting up to %v for %d transfers to finalize...\n", timeout, total)
+	finalized := successPolicy{commitment: rpc.CommitmentFinalized}
+
+	deadline := time.Now().Add(timeout)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		var stillPending []int
+		for start := 0; start < len(pending); start += maxSignaturesPerStatusRequest {
+			end := start + maxSignaturesPerStatusRequest
+			if end > len(pending) {
+				end = len(pending)
+			}
+			batch := pending[start:end]
+
+			sigs := make([]solana.Signature, len(batch))
+			for j, i := range batch {
+				sigs[j] = solana.MustSignatureFromBase58(results[i].Signature)
+			}
+
+			statuses, err := r.client.GetSignatureStatuses(ctx, r.config.SearchTransactionHistory, sigs...)
+			if err != nil {
+				log.Printf("Warning: failed to check finalization: %v", err)
+				stillPending = append(stillPending, batch...)
+				continue
+			}
+
+			for j, i := range batch {
+				if j < len(statuses.Value) && statuses.Value[j] != nil && finalized.reached(statuses.Value[j]) {
+					results[i].ConfirmationStatus = string(rpc.ConfirmationStatusFinalized)
+					r.recordState(byID[results[i].ID], results[i], "Finalized")
+					continue
+				}
+				stillPending = append(stillPending, i)
+			}
+		}
+		pending = stillPending
+
+		if len(pending) > 0 {
+			select {
+			case <-ctx.Done():
+				return len(pending)
+			case <-time.After(2 * time.Second):
+			}
+		}
+	}
+
+	fmt.Printf("Finalized: %d of %d\n", total-len(pending), total)
+	return len(pending)
+}
+
+// trackInFlight registers transfer id as executing and returns the function
+// that unregisters it.
+func (r *transferRunner) trackInFlight(id string) func() {
+	r.inFlightMu.Lock()
+	if r.inFlight == nil {
+		r.inFlight = make(map[string]time.Time)
+	}
+	r.inFlight[id] = time.Now()
+	r.inFlightMu.Unlock()
+
+	return func() {
+		r.inFlightMu.Lock()
+		delete(r.inFlight, id)
+		r.inFlightMu.Unlock()
+	}
+}
+
+// watchStuckTransfers logs, every interval until ctx is done, the transfers
+// that have been executing for longer than threshold, longest first.
+func (r *transferRunner) watchStuckTransfers(ctx context.Context, threshold, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		type running struct {
+			id      string
+			elapsed time.Duration
+		}
+		var stuck []running
+		r.inFlightMu.Lock()
+		for id, start := range r.inFlight {
+			if elapsed := time.Since(start); elapsed >= threshold {
+				stuck = append(stuck, running{id, elapsed})
+			}
+		}
+		r.inFlightMu.Unlock()
+
+		if len(stuck) == 0 {
+			continue
+		}
+		sort.Slice(stuck, func(i, j int) bool { return stuck[i].elapsed > stuck[j].elapsed })
+		parts := make([]string, len(stuck))
+		for i, transfer := range stuck {
+			parts[i] = fmt.Sprintf("%s (%v)", transfer.id, transfer.elapsed.Round(time.Second))
+		}
+		log.Printf("Warning: %d transfers running longer than %v: %s", len(stuck), threshold, strings.Join(parts, ", "))
+	}
+}
+
+func (r *transferRunner) executeTransfer(ctx context.Context, transfer TransferInstruction, wg *sync.WaitGroup, results chan<- TransferResult) {
+	defer wg.Done()
+	defer r.trackInFlight(transfer.ID)()
+
+	result := TransferResult{
+		ID:     transfer.ID,
+		Amount: transfer.Amount,
+	}
+
+	// Record and report the final outcome however the transfer ends
+	defer func() {
+		if isCancellation(ctx, result.Error) {
+			result.Status = "Cancelled"
+		}
+
+		status := result.Status
+		switch {
+		case (status == "Cancelled" || status == "Unconfirmed" || status == "Timeout") && result.Signature != "":
+			// It may still land, so it must not be resent on resume
+			status = "Submitted"
+		case status == "":
+			status = "Failed"
+		}
+		// A submit-only send was recorded as it happened
+		if status != "Submitted" || !r.submitOnly {
+			r.recordState(transfer, result, status)
+		}
+		// Hand back what the transfer reserved from its sender if it never landed
+		if r.config.KeepSenderRentExempt && result.FromAccount != "" &&
+			(result.Signature == "" || errors.Is(result.Error, errBlockhashExpired)) {
+			r.releaseSenderSpend(result.FromAccount, transfer.ID)
+		}
+
+		results <- result
+	}()
+
+	startTime := time.Now()
+
+	// Don't start new work after shutdown was requested
+	if err := ctx.Err(); err != nil {
+		result.Error = err
+		return
+	}
+
+	if transfer.DelayBeforeMs > 0 {
+		select {
+		case <-ctx.Done():
+			result.Error = ctx.Err()
+			return
+		case <-time.After(time.Duration(transfer.DelayBeforeMs) * time.Millisecond):
+		}
+	}
+
+	if transfer.Condition != "" {
+		met, reason, err := r.checkCondition(ctx, transfer)
+		if err != nil {
+			result.Error = fmt.Errorf("failed to check condition: %w", err)
+			return
+		}
+		if !met {
+			result.ToAccount = transfer.ToAddress
+			result.Status = "Skipped"
+			result.SkipReason = reason
+			result.ProcessingTime = time.Since(startTime)
+			return
+		}
+	}
+
+	tx, err := r.transactionFor(ctx, &transfer, &result)
+	if err != nil {
+		result.Error = err
+		return
+	}
+
+	// Estimate the fee before paying it
+	if r.config.EstimateFees || r.config.MaxFeeLamports > 0 {
+		result.EstimatedFee, err = estimateFee(ctx, r.client, tx, r.readCommitment())
+		if err != nil {
+			if r.config.MaxFeeLamports > 0 {
+				result.Error = fmt.Errorf("cannot check max_fee_lamports: %w", err)
+				return
+			}
+			log.Printf("Warning: fee estimate for transfer %s failed: %v", transfer.ID, err)
+		}
+	}
+	if r.config.MaxFeeLamports > 0 && result.EstimatedFee > r.config.MaxFeeLamports {
+		result.Error = fmt.Errorf("estimated fee %d lamports exceeds max_fee_lamports %d, not sent",
+			result.EstimatedFee, r.config.MaxFeeLamports)
+		return
+	}
+
+	commitment := rpc.CommitmentType(r.config.Commitment)
+	if transfer.Commitment != "" {
+		commitment = rpc.CommitmentType(transfer.Commitment)
+	}
+	resends := r.config.ExpiryResends
+	if resends == 0 {
+		resends = defaultExpiryResends
+	}
+	timeout := confirmationTimeout(r.config)
+
+	var sig solana.Signature
+	var conf confirmation
+	for {
+		if r.latency != nil {
+			if err := r.latency.limiter.Wait(ctx); err != nil {
+				result.Error = err
+				return
+			}
+		}
+
+		// Send transaction
+		sendStart := time.Now()
+		sig, err = r.sendTransaction(ctx, tx)
+		result.Attempts++
+		for retry := 0; err != nil && retry < r.config.MaxRetries && isRetryableSendError(err); retry++ {
+			delay := sendRetryDelay << retry
+			if delay > maxSendRetryDelay {
+				delay = maxSendRetryDelay
+			}
+			log.Printf("Transfer %s: send failed (%v), retrying in %v (%d of %d)",
+				transfer.ID, err, delay, retry+1, r.config.MaxRetries)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			if isBlockhashNotFound(err) {
+				// The node has never seen the blockhash, so the rejected
+				// transaction cannot land and is re-signed with a fresh one
+				if r.blockhashes != nil {
+					if refreshErr := r.blockhashes.Refresh(ctx); refreshErr != nil {
+						log.Printf("Warning: failed to refresh blockhash: %v", refreshErr)
+					}
+				}
+				if tx, err = r.buildTransaction(ctx, &transfer, &result); err != nil {
+					result.Error = fmt.Errorf("failed to rebuild transaction: %w", err)
+					return
+				}
+			}
+			sig, err = r.sendTransaction(ctx, tx)
+			result.Attempts++
+			// A send that timed out may still have reached the node
+			if err != nil && isAlreadyProcessed(err) {
+				sig, err = tx.Signatures[0], nil
+			}
+		}
+		if err != nil {
+			if isTooLargeError(err) {
+				size := 0
+				if data, marshalErr := tx.MarshalBinary(); marshalErr == nil {
+					size = len(data)
+				}
+				tooLarge := newTransactionTooLargeError(tx, size)
+				tooLarge.RejectedByNode = true
+				err = tooLarge
+			}
+			if status, detail := classifySendError(err, result.FromAccount); status != "Failed" {
+				result.Status = status
+				err = fmt.Errorf("%s: %w", detail, err)
+			}
+			result.Error = fmt.Errorf("failed to send transaction: %w", err)
+			return
+		}
+		result.Signature = sig.String()
+		result.SendTime = time.Since(sendStart)
+
+		// Record the send before confirming so a crash cannot lead to a resend
+		r.recordState(transfer, result, "Submitted")
+
+		// Confirmation is left to the background confirmer
+		if r.submitOnly {
+			result.Status = "Submitted"
+			result.ProcessingTime = time.Since(startTime)
+			return
+		}
+
+		// Check transaction status
+		confirmStart := time.Now()
+		confirmCtx, cancelConfirm := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			confirmCtx, cancelConfirm = context.WithTimeout(ctx, timeout)
+		}
+		conf, err = r.confirmBeforeExpiry(confirmCtx, sig, commitment, result.lastValidBlockHeight)
+		timedOut := errors.Is(confirmCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		cancelConfirm()
+		result.ConfirmTime = time.Since(confirmStart)
+		if errors.Is(err, errBlockhashExpired) && result.Resends < resends {
+			// The old transaction can no longer land, so a resend cannot pay twice
+			result.Resends++
+			log.Printf("Transfer %s: blockhash expired before %s landed, resending (%d of %d)",
+				transfer.ID, sig, result.Resends, resends)
+			r.recordState(transfer, result, "Expired")
+			tx, err = r.buildTransaction(ctx, &transfer, &result)
+			if err != nil {
+				result.Error = fmt.Errorf("failed to rebuild expired transaction: %w", err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			// Sent, but whether it landed is unknown
+			switch {
+			case errors.Is(err, errBlockhashExpired):
+			case timedOut:
+				result.Status = "Timeout"
+				result.Error = fmt.Errorf("not confirmed within %v", timeout)
+				return
+			default:
+				result.Status = "Unconfirmed"
+			}
+			result.Error = fmt.Errorf("failed to get transaction status: %w", err)
+			return
+		}
+		break
+	}
+
+	result.ConfirmedVia = conf.Via
+	if conf.TxErr != nil {
+		result.Status = "Failed"
+		result.Error = fmt.Errorf("transaction failed: %v", conf.TxErr)
+	} else {
+		result.Status = "Confirmed"
+		result.ConfirmationStatus = conf.ConfirmationStatus
+		result.ExplorerURL = explorerURL(r.config, result.Signature)
+	}
+
+	if r.latency != nil && result.Status == "Confirmed" {
+		r.latency.Observe(result.ConfirmTime)
+	}
+
+	// Confirmation alone may not be enough for the configured success check
+	if r.config.SuccessCheck == "recipient_balance" && result.Status == "Confirmed" && result.Mint == "" {
+		if err := r.checkRecipientBalance(ctx, result, commitment); err != nil {
+			result.Status = "Failed"
+			result.Error = err
+		}
+	}
+
+	if r.config.ReportSenderBalance && result.Status == "Confirmed" {
+		balance, err := r.client.GetBalance(ctx, solana.MustPublicKeyFromBase58(result.FromAccount), r.readCommitment())
+		if err != nil {
+			log.Printf("Warning: failed to read sender balance after transfer %s: %v", transfer.ID, err)
+		} else {
+			result.SenderBalanceAfter = balance.Value
+			result.senderBalanceRead = true
+		}
+	}
+
+	// Compare the estimate against what was actually charged, and read the
+	// compute units used from the same metadata
+	if (r.config.VerifyFees || r.config.ReportComputeUnits) && result.Status == "Confirmed" {
+		meta, err := r.waitForMeta(ctx, sig)
+		switch {
+		case errors.Is(err, errTransactionNotFound):
+			log.Printf("Warning: transfer %s not yet confirmed after %v, fee and compute units not read", transfer.ID, metaWaitTimeout)
+		case err != nil:
+			log.Printf("Warning: failed to read metadata for transfer %s: %v", transfer.ID, err)
+		case r.config.VerifyFees:
+			result.Fee = meta.Fee
+			if r.config.EstimateFees && result.EstimatedFee != 0 && result.Fee != result.EstimatedFee {
+				log.Printf("Warning: transfer %s was charged %d lamports, estimated %d",
+					transfer.ID, result.Fee, result.EstimatedFee)
+			}
+		}
+		// Older nodes don't report computeUnitsConsumed
+		if err == nil && r.config.ReportComputeUnits && meta.ComputeUnitsConsumed != nil {
+			result.ComputeUnits = *meta.ComputeUnitsConsumed
+			result.computeUnitsRead = true
+		}
+	}
+
+	result.ProcessingTime = time.Since(startTime)
+}
+
+// sendTransaction sends tx to rpc_url and, in parallel, to every broadcast
+// endpoint, returning as soon as one accepts it. All of them send the same
+// signed transaction, so it can land at most once and is confirmed by its
+// one signature; "already processed" means another endpoint got there first.
+func (r *transferRunner) sendTransaction(ctx context.Context, tx *solana.Transaction) (solana.Signature, error) {
+	opts := rpc.TransactionOpts{
+		SkipPreflight:       false,
+		PreflightCommitment: rpc.CommitmentType(r.config.PreflightCommitment),
+	}
+	if len(r.broadcast) == 0 {
+		return r.client.SendTransactionWithOpts(ctx, tx, opts)
+	}
+
+	type sent struct {
+		primary bool
+		sig     solana.Signature
+		err     error
+	}
+	clients := append([]*rpc.Client{r.client}, r.broadcast...)
+	results := make(chan sent, len(clients))
+	for i, client := range clients {
+		go func(primary bool, client *rpc.Client) {
+			sig, err := client.SendTransactionWithOpts(ctx, tx, opts)
+			results <- sent{primary: primary, sig: sig, err: err}
+		}(i == 0, client)
+	}
+
+	// Report rpc_url's error if every endpoint rejects it
+	var firstErr error
+	for range clients {
+		result := <-results
+		switch {
+		case result.err == nil:
+			return result.sig, nil
+		case isAlreadyProcessed(result.err):
+			return tx.Signatures[0], nil
+		case result.primary || firstErr == nil:
+			firstErr = result.err
+		}
+	}
+	return solana.Signature{}, firstErr
+}
+
+// sendRetryDelay is the wait before the first retry of a transient send
+// error; it doubles with every retry up to maxSendRetryDelay.
+const (
+	sendRetryDelay    = 500 * time.Millisecond
+	maxSendRetryDelay = 10 * time.Second
+)
+
+// transientSendErrors are fragments of send errors that may not happen
+// again: the node was overloaded, unreachable or too slow to answer.
+var transientSendErrors = []string{
+	"timeout", "deadline exceeded", "connection reset", "connection refused", "EOF",
+	"429", "Too Many Requests", "502", "503", "Service Unavailable", "504",
+	"Node is behind", "unhealthy", "busy",
+}
+
+// isRetryableSendError reports whether sending the transaction again may
+// succeed. Funding problems and a bad signature are terminal: a retry would
+// be rejected the same way.
+func isRetryableSendError(err error) bool {
+	if status, _ := classifySendError(err, ""); status != "Failed" || isTooLargeError(err) {
+		return false
+	}
+	text := err.Error()
+	if strings.Contains(text, "SignatureFailure") || strings.Contains(text, "signature verification") {
+		return false
+	}
+	if isBlockhashNotFound(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, fragment := range transientSendErrors {
+		if strings.Contains(text, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlockhashNotFound reports whether a send was rejected because the node
+// does not know the transaction's blockhash.
+func isBlockhashNotFound(err error) bool {
+	text := err.Error()
+	return strings.Contains(text, "BlockhashNotFound") || strings.Contains(text, "Blockhash not found")
+}
+
+// isAlreadyProcessed reports whether a send was rejected because the
+// transaction has already been received.
+func isAlreadyProcessed(err error) bool {
+	text := err.Error()
+	return strings.Contains(text, "AlreadyProcessed") || strings.Contains(text, "already been processed")
+}
+
+// newBroadcastClients returns a client for every broadcast endpoint, sharing
+// the connection pool settings of the main client.
+func newBroadcastClients(config *Config) []*rpc.Client {
+	var clients []*rpc.Client
+	for _, endpoint := range config.BroadcastEndpoints {
+		var transport http.RoundTripper = newHTTPTransport(config)
+		if config.DebugRPC {
+			transport = &debugTransport{base: transport}
+		}
+		clients = append(clients, rpc.NewWithCustomRPCClient(jsonrpc.NewClientWithOpts(endpoint, &jsonrpc.RPCClientOpts{
+			HTTPClient: &http.Client{Transport: transport},
+		})))
+	}
+	return clients
+}
+
+// checkRecipientBalance is the recipient_balance success check: after a
+// confirmed SOL transfer the recipient must hold at least the amount sent.
+func (r *transferRunner) checkRecipientBalance(ctx context.Context, result TransferResult, commitment rpc.CommitmentType) error {
+	recipient, err := solana.PublicKeyFromBase58(result.ToAccount)
+	if err != nil {
+		return fmt.Errorf("invalid destination address: %w", err)
+	}
+	balance, err := r.client.GetBalance(ctx, recipient, commitment)
+	if err != nil {
+		return fmt.Errorf("success check: failed to get recipient balance: %w", err)
+	}
+	if balance.Value < result.Amount {
+		return fmt.Errorf("success check: confirmed, but recipient %s holds %d lamports, less than the %d sent", recipient, balance.Value, result.Amount)
+	}
+	return nil
+}
+
+// defaultConfirmationTimeout is how long a transfer waits for each sent
+// transaction to confirm unless confirmation_timeout_seconds says otherwise.
+const defaultConfirmationTimeout = 60 * time.Second
+
+// confirmationTimeout returns the configured confirmation timeout, or zero
+// if it is disabled.
+func confirmationTimeout(config *Config) time.Duration {
+	switch {
+	case config.ConfirmationTimeoutSeconds < 0:
+		return 0
+	case config.ConfirmationTimeoutSeconds == 0:
+		return defaultConfirmationTimeout
+	}
+	return time.Duration(config.ConfirmationTimeoutSeconds) * time.Second
+}
+
+// defaultExpiryResends is how many times a transfer is resent after its
+// blockhash expires unless expiry_resends says otherwise.
+const defaultExpiryResends = 2
+
+// expiryCheckInterval is how often confirmBeforeExpiry compares the block
+// height against the transaction's last valid block height.
+const expiryCheckInterval = 5 * time.Second
+
+// errBlockhashExpired reports a transaction whose blockhash expired without
+// it landing; it can never land and may be resent.
+var errBlockhashExpired = errors.New("blockhash expired before the transaction landed")
+
+// confirmBeforeExpiry waits for sig like confirm, but gives up with
+// errBlockhashExpired once the finalized block height passes
+// lastValidBlockHeight and the transaction is still unknown. A zero
+// lastValidBlockHeight (durable nonce) never expires.
+func (r *transferRunner) confirmBeforeExpiry(ctx context.Context, sig solana.Signature, commitment rpc.CommitmentType, lastValidBlockHeight uint64) (confirmation, error) {
+	if lastValidBlockHeight == 0 {
+		return r.confirm(ctx, sig, commitment)
+	}
+
+	confirmCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var expired int32
+	go func() {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-confirmCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			height, err := r.client.GetBlockHeight(confirmCtx, rpc.CommitmentFinalized)
+			if err != nil || height <= lastValidBlockHeight {
+				continue
+			}
+			// Had it landed, it would be in a block at or below the last
+			// valid height, so its status would be known by now
+			status, err := getSignatureStatus(confirmCtx, r.client, sig, true)
+			if err != nil {
+				continue
+			}
+			if status == nil {
+				atomic.StoreInt32(&expired, 1)
+				cancel()
+			}
+			return
+		}
+	}()
+
+	conf, err := r.confirm(confirmCtx, sig, commitment)
+	if err != nil && atomic.LoadInt32(&expired) == 1 && ctx.Err() == nil {
+		return conf, errBlockhashExpired
+	}
+	return conf, err
+}
+
+// insufficientLamports matches the System program's log for a transfer that
+// exceeds the sender's balance.
+var insufficientLamports = regexp.MustCompile(`insufficient lamports (\d+), need (\d+)`)
+
+// rentAccountIndex extracts the account of an InsufficientFundsForRent
+// transaction error.
+var rentAccountIndex = regexp.MustCompile(`InsufficientFundsForRent\W+account_index\W+(\d+)`)
+
+// classifySendError tells apart the most common preflight rejections, which
+// otherwise surface as similar generic errors: a sender (fee payer) that does
+// not exist, one without enough funds and a transfer that would leave an
+// account below the rent-exempt minimum. It returns the status to report and
+// a description naming the account, or "Failed" for anything else.
+func classifySendError(err error, sender string) (string, string) {
+	text := err.Error()
+	var rpcErr *jsonrpc.RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Data != nil {
+		// Preflight logs and the transaction error are in the error data
+		if data, marshalErr := json.Marshal(rpcErr.Data); marshalErr == nil {
+			text += " " + string(data)
+		}
+	}
+
+	switch {
+	case strings.Contains(text, "AccountNotFound") || strings.Contains(text, "no record of a prior credit"):
+		return "AccountNotFound", fmt.Sprintf("account %s not found (never funded)", sender)
+	case strings.Contains(text, "InsufficientFundsForRent"):
+		account := "an account"
+		if match := rentAccountIndex.FindStringSubmatch(text); match != nil {
+			account = "account #" + match[1]
+			if match[1] == "0" {
+				account = "account " + sender
+			}
+		}
+		return "InsufficientFundsForRent", fmt.Sprintf("transfer would leave %s with a balance below the rent-exempt minimum; "+
+			"send its whole balance, leave at least the minimum or set keep_sender_rent_exempt", account)
+	case insufficientLamports.MatchString(text):
+		match := insufficientLamports.FindStringSubmatch(text)
+		return "InsufficientFunds", fmt.Sprintf("account %s has insufficient funds (%s lamports, need %s)", sender, match[1], match[2])
+	case strings.Contains(text, "InsufficientFunds") || strings.Contains(text, "insufficient funds"):
+		return "InsufficientFunds", fmt.Sprintf("account %s has insufficient funds", sender)
+	}
+	return "Failed", ""
+}
+
+// plainMarkers replaces the report's emoji markers with ASCII ones.
+var plainMarkers = strings.NewReplacer(
+	"✅", "[OK]",
+	"❌", "[FAIL]",
+	"⚠️ ", "[WARN]",
+	"⏹", "[STOP]",
+	"↻", "[RETRY]",
+	"📤", "[SENT]",
+	"⏳", "[UNCONFIRMED]",
+	"⏭", "[SKIPPED]",
+	"•", "-",
+)
+
+// PlainOutput makes reports use ASCII markers instead of emoji; the CLI
+// sets it with -plain, or when stdout is not a terminal.
+var PlainOutput bool
+
+// report prints like fmt.Printf, with ASCII markers instead of emoji in
+// plain output.
+func report(format string, a ...interface{}) {
+	printTo(os.Stdout, format, a...)
+}
+
+// printTo prints like report to w, or nowhere if w is nil.
+func printTo(w io.Writer, format string, a ...interface{}) {
+	if w == nil {
+		return
+	}
+	if PlainOutput {
+		format = plainMarkers.Replace(format)
+	}
+	fmt.Fprintf(w, format, a...)
+}
+
+// printf writes a progress message to the run's progress writer, if any.
+func (r *transferRunner) printf(format string, a ...interface{}) {
+	printTo(r.progress, format, a...)
+}
+
+// explorerURL returns the explorer link for signature, or "" when no
+// explorer is configured.
+func explorerURL(config *Config, signature string) string {
+	if config.ExplorerBaseURL == "" {
+		return ""
+	}
+	link := strings.TrimSuffix(config.ExplorerBaseURL, "/") + "/tx/" + signature
+	if config.ExplorerCluster != "" {
+		link += "?cluster=" + url.QueryEscape(config.ExplorerCluster)
+	}
+	return link
+}
+
+// isRetryable reports whether a failed result can be attempted again in a
+// later round: it never reached the network, so resending cannot pay twice,
+// and it failed for a transient reason, so a later round may succeed.
+// Permanent failures such as missing funds are final at once.
+func isRetryable(result TransferResult) bool {
+	return result.Error != nil && result.Status != "Cancelled" && result.Signature == "" &&
+		isRetryableSendError(result.Error)
+}
+
+// isCancellation reports whether err is the result of ctx being cancelled
+// (e.g. Ctrl+C) rather than a real failure.
+func isCancellation(ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, context.Canceled) || ctx.Err() == context.Canceled
+}
+
+// getSignatureStatus returns the status of a single signature, or nil if the
+// node does not know it (yet).
+func getSignatureStatus(ctx context.Context, client *rpc.Client, sig solana.Signature, searchHistory bool) (*rpc.SignatureStatusesResult, error) {
+	statuses, err := client.GetSignatureStatuses(ctx, searchHistory, sig)
+	if err != nil {
+		return nil, err
+	}
+	if len(statuses.Value) == 0 {
+		return nil, nil
+	}
+	return statuses.Value[0], nil
+}
+
+// ConfirmSubmitted waits for every transfer the state file has as
+// Submitted to reach the configured commitment or fail, records the outcome
+// and reports how the submit-only run ended. Transfers whose blockhash
+// expired without landing are recorded as Expired, so a resumed run sends
+// them again; those still unknown at the timeout stay Submitted, so it does
+// not.
+func ConfirmSubmitted(ctx context.Context, client *rpc.Client, config *Config) error {
+	records, err := loadState(config.StateFile)
+	if err != nil {
+		return err
+	}
+	state, err := openStateFile(config.StateFile)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	var pending []stateRecord
+	for _, record := range records {
+		if record.Status == "Submitted" && record.Signature != "" {
+			pending = append(pending, record)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	if len(pending) == 0 {
+		fmt.Println("No submitted transfers to confirm")
+		return nil
+	}
+
+	timeout := time.Duration(config.SubmitConfirmTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 120 * time.Second
+	}
+	policy := newSuccessPolicy(config, rpc.CommitmentType(config.Commitment))
+	fmt.Printf("Confirming %d submitted transfers for up to %v...\n", len(pending), timeout)
+
+	counts := make(map[string]int)
+	// Records whose signature cannot be parsed stay Submitted
+	invalid := 0
+	deadline := time.Now().Add(timeout)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		height, err := client.GetBlockHeight(ctx, rpc.CommitmentFinalized)
+		if err != nil {
+			log.Printf("Warning: failed to read block height, not checking expiry: %v", err)
+			height = 0
+		}
+
+		var stillPending []stateRecord
+		for start := 0; start < len(pending); start += maxSignaturesPerStatusRequest {
+			end := start + maxSignaturesPerStatusRequest
+			if end > len(pending) {
+				end = len(pending)
+			}
+
+			var batch []stateRecord
+			var sigs []solana.Signature
+			for _, record := range pending[start:end] {
+				sig, err := solana.SignatureFromBase58(record.Signature)
+				if err != nil {
+					log.Printf("Warning: skipping transfer %s, invalid signature %q in state file: %v", record.ID, record.Signature, err)
+					invalid++
+					continue
+				}
+				batch = append(batch, record)
+				sigs = append(sigs, sig)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+
+			statuses, err := client.GetSignatureStatuses(ctx, config.SearchTransactionHistory, sigs...)
+			if err != nil {
+				log.Printf("Warning: failed to check submitted transfers: %v", err)
+				stillPending = append(stillPending, batch...)
+				continue
+			}
+
+			for j, record := range batch {
+				var status *rpc.SignatureStatusesResult
+				if j < len(statuses.Value) {
+					status = statuses.Value[j]
+				}
+
+				// Past its last valid height, a transaction the node does not
+				// know either landed long ago or never will; the history tells
+				expired := status == nil && record.LastValidBlockHeight > 0 && height > record.LastValidBlockHeight
+				if expired && !config.SearchTransactionHistory {
+					status, err = getSignatureStatus(ctx, client, sigs[j], true)
+					if err != nil {
+						log.Printf("Warning: failed to check transfer %s in the transaction history: %v", record.ID, err)
+						stillPending = append(stillPending, record)
+						continue
+					}
+				}
+
+				switch {
+				case status != nil && status.Err != nil:
+					record.Status = "Failed"
+					record.Error = fmt.Sprintf("transaction failed: %v", status.Err)
+				case status != nil && policy.reached(status):
+					record.Status = "Confirmed"
+				case status == nil && expired:
+					record.Status = "Expired"
+					record.Error = errBlockhashExpired.Error()
+				default:
+					stillPending = append(stillPending, record)
+					continue
+				}
+
+				counts[record.Status]++
+				if record.Status == "Confirmed" {
+					report("✅ %s: confirmed (%s)\n", record.ID, record.Signature)
+				} else {
+					report("❌ %s: %s (%s)\n", record.ID, record.Error, record.Signature)
+				}
+				record.Timestamp = time.Now().UTC()
+				if err := state.Append(record); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}
+		}
+		pending = stillPending
+
+		if len(pending) > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(2 * time.Second):
+			}
+		}
+	}
+
+	for _, record := range pending {
+		report("⏹ %s: still unconfirmed after %v (%s)\n", record.ID, timeout, record.Signature)
+	}
+	counts["Submitted"] = len(pending) + invalid
+	fmt.Printf("\nBackground confirmation: %s\n", formatCounts(counts))
+
+	if counts["Failed"] > 0 || counts["Expired"] > 0 || counts["Submitted"] > 0 {
+		return fmt.Errorf("%d failed, %d expired, %d unconfirmed", counts["Failed"], counts["Expired"], counts["Submitted"])
+	}
+	return nil
+}
+
+// resultRecord is the JSON form of a TransferResult.
+type resultRecord struct {
+	ID                 string  `json:"id"`
+	From               string  `json:"from"`
+	To                 string  `json:"to"`
+	Mint               string  `json:"mint,omitempty"`
+	Amount             uint64  `json:"amount"`
+	Signature          string  `json:"signature,omitempty"`
+	Status             string  `json:"status"`
+	ConfirmationStatus string  `json:"confirmation_status,omitempty"`
+	ConfirmedVia       string  `json:"confirmed_via,omitempty"`
+	ProcessingTimeMs   int64   `json:"processing_time_ms"`
+	BlockhashTimeMs    int64   `json:"blockhash_time_ms"`
+	SendTimeMs         int64   `json:"send_time_ms"`
+	ConfirmTimeMs      int64   `json:"confirm_time_ms"`
+	ExplorerURL        string  `json:"explorer_url,omitempty"`
+	Resends            int     `json:"resends,omitempty"`
+	Attempts           int     `json:"attempts,omitempty"`
+	SenderBalanceAfter *uint64 `json:"sender_balance_after,omitempty"`
+	ComputeUnits       *uint64 `json:"compute_units,omitempty"`
+	SkipReason         string  `json:"skip_reason,omitempty"`
+	Sequence           uint64  `json:"sequence,omitempty"`
+	Error              string  `json:"error,omitempty"`
+}
+
+// newResultRecord converts a TransferResult to its JSON form.
+func newResultRecord(result TransferResult) resultRecord {
+	record := resultRecord{
+		ID:                 result.ID,
+		From:               result.FromAccount,
+		To:                 result.ToAccount,
+		Mint:               result.Mint,
+		Amount:             result.Amount,
+		Signature:          result.Signature,
+		Status:             result.Status,
+		ConfirmationStatus: result.ConfirmationStatus,
+		ConfirmedVia:       result.ConfirmedVia,
+		ProcessingTimeMs:   result.ProcessingTime.Milliseconds(),
+		BlockhashTimeMs:    result.BlockhashTime.Milliseconds(),
+		SendTimeMs:         result.SendTime.Milliseconds(),
+		ConfirmTimeMs:      result.ConfirmTime.Milliseconds(),
+		ExplorerURL:        result.ExplorerURL,
+		SkipReason:         result.SkipReason,
+		Sequence:           result.Sequence,
+		Resends:            result.Resends,
+		Attempts:           result.Attempts,
+	}
+	if result.senderBalanceRead {
+		balance := result.SenderBalanceAfter
+		record.SenderBalanceAfter = &balance
+	}
+	if result.computeUnitsRead {
+		units := result.ComputeUnits
+		record.ComputeUnits = &units
+	}
+	if result.Error != nil {
+		record.Error = result.Error.Error()
+		if record.Status == "" {
+			record.Status = "Failed"
+		}
+	}
+	return record
+}
+
+// runFailureHook runs the configured on-failure command for a failed
+// transfer. The result is passed as JSON on stdin and as TRANSFER_*
+// environment variables; the command's output goes to the log.
+func runFailureHook(ctx context.Context, command string, timeout time.Duration, result TransferResult) {
+	record := newResultRecord(result)
+	payload, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Warning: failed to encode failure for hook: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"TRANSFER_ID="+record.ID,
+		"TRANSFER_FROM="+record.From,
+		"TRANSFER_TO="+record.To,
+		"TRANSFER_AMOUNT="+strconv.FormatUint(record.Amount, 10),
+		"TRANSFER_SIGNATURE="+record.Signature,
+		"TRANSFER_STATUS="+record.Status,
+		"TRANSFER_ERROR="+record.Error,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		log.Printf("On-failure hook output for transfer %s: %s", record.ID, strings.TrimSpace(string(output)))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("Warning: on-failure hook for transfer %s timed out after %v", record.ID, timeout)
+	} else if err != nil {
+		log.Printf("Warning: on-failure hook for transfer %s failed: %v", record.ID, err)
+	}
+}
+
+// sqliteSchema creates the results table shared by every run written to a
+// SQLite sink.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS transfer_results (
+	run_id              TEXT NOT NULL,
+	id                  TEXT NOT NULL,
+	from_account        TEXT,
+	to_account          TEXT,
+	amount              INTEGER,
+	signature           TEXT,
+	status              TEXT NOT NULL,
+	confirmation_status TEXT,
+	confirmed_via       TEXT,
+	processing_time_ms  INTEGER,
+	blockhash_time_ms   INTEGER,
+	send_time_ms        INTEGER,
+	confirm_time_ms     INTEGER,
+	error               TEXT,
+	recorded_at         TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transfer_results_run_id ON transfer_results (run_id);
+CREATE INDEX IF NOT EXISTS transfer_results_signature ON transfer_results (signature);
+`
+
+// runManifest documents a run for later audits: what configuration it ran
+// with, against which endpoints, when, and where its records went.
+type runManifest struct {
+	RunID       string         `json:"run_id"`
+	Version     string         `json:"version"`
+	Revision    string         `json:"revision,omitempty"`
+	ConfigFile  string         `json:"config_file,omitempty"`
+	ConfigHash  string         `json:"config_sha256"`
+	StartedAt   time.Time      `json:"started_at"`
+	FinishedAt  time.Time      `json:"finished_at"`
+	Endpoints   []string       `json:"endpoints"`
+	Broadcast   []string       `json:"broadcast_endpoints,omitempty"`
+	StateFile   string         `json:"state_file,omitempty"`
+	SQLite      string         `json:"sqlite,omitempty"`
+	Output      string         `json:"output,omitempty"`
+	Transfers   int            `json:"transfers"`
+	StatusCount map[string]int `json:"status_counts"`
+	Phases      *phaseTimes    `json:"phases,omitempty"`
+}
+
+// newRunManifest fills in everything known about the run except its
+// timing and outcome. The config hash covers the resolved configuration,
+// transfers included, so any change to what was run changes it.
+func newRunManifest(config *Config, runID string) (*runManifest, error) {
+	resolved, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	hash := sha256.Sum256(resolved)
+
+	manifest := &runManifest{
+		RunID:      runID,
+		Version:    Version,
+		ConfigFile: viper.ConfigFileUsed(),
+		ConfigHash: hex.EncodeToString(hash[:]),
+		StateFile:  config.StateFile,
+		Transfers:  len(config.Transfers),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				manifest.Revision = setting.Value
+			}
+		}
+	}
+	for _, endpoint := range config.Endpoints() {
+		manifest.Endpoints = append(manifest.Endpoints, redactEndpoint(endpoint))
+	}
+	for _, endpoint := range config.BroadcastEndpoints {
+		manifest.Broadcast = append(manifest.Broadcast, redactEndpoint(endpoint))
+	}
+	return manifest, nil
+}
+
+// redactEndpoint hides the credentials in an endpoint URL.
+func redactEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "REDACTED"
+	}
+	return redactURL(u)
+}
+
+// Write saves the manifest to path as indented JSON.
+func (m *runManifest) Write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// writeRetryConfig writes a config to path that repeats this run's settings
+// with only the transfers that did not confirm, so it can be run as is. It
+// returns how many transfers it holds and how many of those were sent and
+// may still land. The file holds private keys, all of them base64 as
+// config's are once normalized, and is created 0600.
+func writeRetryConfig(path string, config *Config, transfers []TransferInstruction, results []TransferResult) (int, int, error) {
+	byID := make(map[string]TransferResult, len(results))
+	for _, result := range results {
+		byID[result.ID] = result
+	}
+
+	var retry []map[string]interface{}
+	sent := 0
+	for _, transfer := range transfers {
+		result, ok := byID[transfer.ID]
+		if !ok {
+			continue
+		}
+		// Submitted transfers are still being confirmed in the background
+		status := newResultRecord(result).Status
+		if status == "Confirmed" || status == "Submitted" || status == "Skipped" {
+			continue
+		}
+		if result.Signature != "" {
+			sent++
+		}
+		retry = append(retry, transferFields(transfer))
+	}
+
+	v := viper.New()
+	for key, value := range viper.AllSettings() {
+		v.Set(key, value)
+	}
+	v.Set("transfers", retry)
+	v.Set("key_format", "base64")
+	if len(config.FeePayerKeys) > 0 {
+		v.Set("fee_payer_keys", config.FeePayerKeys)
+	}
+	if config.Canary != nil && config.Canary.FromPrivateKey != "" {
+		v.Set("canary.from_private_key", config.Canary.FromPrivateKey)
+	}
+
+	// Created 0600 from the start, never readable by others even briefly
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create retry config: %w", err)
+	}
+	encoder := yaml.NewEncoder(file)
+	if err := encoder.Encode(v.AllSettings()); err != nil {
+		file.Close()
+		return 0, 0, fmt.Errorf("failed to write retry config: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		file.Close()
+		return 0, 0, fmt.Errorf("failed to write retry config: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return 0, 0, fmt.Errorf("failed to write retry config: %w", err)
+	}
+	return len(retry), sent, nil
+}
+
+// resultColumns are the CSV columns WriteResults writes, in order.
+var resultColumns = []string{"id", "from", "to", "amount", "signature", "status", "processing_time_ms", "error"}
+
+// WriteResults writes results to path as a JSON array of result records,
+// the format -replay reads, or as CSV with resultColumns if path ends in
+// .csv.
+func WriteResults(path string, results []TransferResult) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if filepath.Ext(path) != ".csv" {
+		records := make([]resultRecord, len(results))
+		for i, result := range results {
+			records[i] = newResultRecord(result)
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(records); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		return file.Close()
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write(resultColumns)
+	for _, result := range results {
+		record := newResultRecord(result)
+		writer.Write([]string{
+			record.ID,
+			record.From,
+			record.To,
+			strconv.FormatUint(record.Amount, 10),
+			record.Signature,
+			record.Status,
+			strconv.FormatInt(record.ProcessingTimeMs, 10),
+			record.Error,
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// transferFields returns the config fields of transfer that are set, keyed
+// like the YAML. A key derived from the mnemonic is left to be derived again.
+func transferFields(transfer TransferInstruction) map[string]interface{} {
+	fields := make(map[string]interface{})
+	value := reflect.ValueOf(transfer)
+	for i := 0; i < value.NumField(); i++ {
+		key := value.Type().Field(i).Tag.Get("mapstructure")
+		field := value.Field(i)
+		if key == "" || field.IsZero() {
+			continue
+		}
+		if field.Kind() == reflect.Pointer {
+			field = field.Elem()
+		}
+		fields[key] = field.Interface()
+	}
+	if transfer.FromDerivationIndex != nil {
+		delete(fields, "from_private_key")
+	}
+	return fields
+}
+
+// sqliteSink records every result of a run in a SQLite database so results
+// can be queried across runs.
+type sqliteSink struct {
+	db    *sql.DB
+	runID string
+}
+
+// openSQLiteSink opens (creating if needed) the database at path and its
+// results table.
+func openSQLiteSink(path, runID string) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema in %s: %w", path, err)
+	}
+	return &sqliteSink{db: db, runID: runID}, nil
+}
+
+// Insert writes one result.
+func (s *sqliteSink) Insert(result TransferResult) error {
+	record := newResultRecord(result)
+	_, err := s.db.Exec(`INSERT INTO transfer_results (
+		run_id, id, from_account, to_account, amount, signature, status,
+		confirmation_status, confirmed_via, processing_time_ms,
+		blockhash_time_ms, send_time_ms, confirm_time_ms, error, recorded_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.runID, record.ID, record.From, record.To, int64(record.Amount), record.Signature, record.Status,
+		record.ConfirmationStatus, record.ConfirmedVia, record.ProcessingTimeMs,
+		record.BlockhashTimeMs, record.SendTimeMs, record.ConfirmTimeMs, record.Error,
+		time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	return err
+}
+
+func (s *sqliteSink) Close() error {
+	return s.db.Close()
+}
+
+// maxSignaturesPerStatusRequest is the limit getSignatureStatuses accepts.
+const maxSignaturesPerStatusRequest = 256
+
+// ReplayResults re-checks every signature recorded in a previous JSON output
+// and writes the records with their current statuses to stdout. It never
+// sends anything.
+func ReplayResults(ctx context.Context, client *rpc.Client, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var records []resultRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+
+	// Only records that made it to the network can be re-checked
+	var pending []int
+	for i, record := range records {
+		if record.Signature != "" {
+			pending = append(pending, i)
+		}
+	}
+
+	counts := make(map[string]int)
+	for start := 0; start < len(pending); start += maxSignaturesPerStatusRequest {
+		end := start + maxSignaturesPerStatusRequest
+		if end > len(pending) {
+			end = len(pending)
+		}
+		batch := pending[start:end]
+
+		sigs := make([]solana.Signature, len(batch))
+		for j, i := range batch {
+			sig, err := solana.SignatureFromBase58(records[i].Signature)
+			if err != nil {
+				return fmt.Errorf("invalid signature for transfer %s: %w", records[i].ID, err)
+			}
+			sigs[j] = sig
+		}
+
+		// Search history since recorded signatures may be arbitrarily old
+		statuses, err := client.GetSignatureStatuses(ctx, true, sigs...)
+		if err != nil {
+			return fmt.Errorf("failed to get transaction statuses: %w", err)
+		}
+
+		for j, i := range batch {
+			var status *rpc.SignatureStatusesResult
+			if j < len(statuses.Value) {
+				status = statuses.Value[j]
+			}
+
+			switch {
+			case status == nil:
+				records[i].Status = "NotFound"
+				records[i].ConfirmationStatus = ""
+			case status.Err != nil:
+				records[i].Status = "Failed"
+				records[i].ConfirmationStatus = string(status.ConfirmationStatus)
+				records[i].Error = fmt.Sprintf("transaction failed: %v", status.Err)
+			default:
+				records[i].Status = "Confirmed"
+				records[i].ConfirmationStatus = string(status.ConfirmationStatus)
+				records[i].Error = ""
+			}
+			counts[records[i].Status]++
+		}
+	}
+
+	log.Printf("Re-checked %d of %d recorded transfers: %s", len(pending), len(records), formatCounts(counts))
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
+
+// LoadExpectations reads the expected status per transfer ID from path,
+// either as a JSON object of ID to status or as a previous JSON output.
+func LoadExpectations(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var expected map[string]string
+	if err := json.Unmarshal(data, &expected); err == nil {
+		return expected, nil
+	}
+
+	var records []resultRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: expected an object of id to status or a results array", path)
+	}
+	expected = make(map[string]string, len(records))
+	for _, record := range records {
+		expected[record.ID] = record.Status
+	}
+	return expected, nil
+}
+
+// DiffExpectations compares the status of each result against the expected
+// one and returns a line per difference, sorted by ID.
+func DiffExpectations(expected map[string]string, results []TransferResult) []string {
+	actual := make(map[string]string, len(results))
+	for _, result := range results {
+		actual[result.ID] = newResultRecord(result).Status
+	}
+
+	ids := make(map[string]bool, len(expected)+len(actual))
+	for id := range expected {
+		ids[id] = true
+	}
+	for id := range actual {
+		ids[id] = true
+	}
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, id := range sorted {
+		want, wantOK := expected[id]
+		got, gotOK := actual[id]
+		switch {
+		case !gotOK:
+			diffs = append(diffs, fmt.Sprintf("%s: expected %s, but it was not in this run", id, want))
+		case !wantOK:
+			diffs = append(diffs, fmt.Sprintf("%s: not expected, got %s", id, got))
+		case want != got:
+			diffs = append(diffs, fmt.Sprintf("%s: expected %s, got %s", id, want, got))
+		}
+	}
+	return diffs
+}
+
+// percentile returns the p-th percentile (nearest rank) of sorted, which
+// must not be empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// phaseTimes breaks a run's time down to tell a slow network from
+// self-imposed throttling. Dispatch and confirmation are summed over
+// transfers and rate limit waits over requests, so with concurrency they
+// can exceed the wall clock.
+type phaseTimes struct {
+	WallClockMs     int64 `json:"wall_clock_ms"`
+	BlockhashMs     int64 `json:"blockhash_ms"`
+	SendMs          int64 `json:"send_ms"`
+	ConfirmMs       int64 `json:"confirm_ms"`
+	RateLimitWaitMs int64 `json:"rate_limit_wait_ms"`
+}
+
+func newPhaseTimes(wallClock time.Duration, results []TransferResult, limiters ...*rateLimiter) *phaseTimes {
+	var blockhash, send, confirm, waited time.Duration
+	for _, result := range results {
+		blockhash += result.BlockhashTime
+		send += result.SendTime
+		confirm += result.ConfirmTime
+	}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			waited += time.Duration(limiter.waited.Load())
+		}
+	}
+	return &phaseTimes{
+		WallClockMs:     wallClock.Milliseconds(),
+		BlockhashMs:     blockhash.Milliseconds(),
+		SendMs:          send.Milliseconds(),
+		ConfirmMs:       confirm.Milliseconds(),
+		RateLimitWaitMs: waited.Milliseconds(),
+	}
+}
+
+func (p *phaseTimes) print() {
+	ms := func(n int64) time.Duration { return time.Duration(n) * time.Millisecond }
+	fmt.Println("Time Breakdown (summed over transfers):")
+	fmt.Printf("   Wall Clock: %v\n", ms(p.WallClockMs))
+	fmt.Printf("   Dispatch: %v (blockhash %v, send %v)\n", ms(p.BlockhashMs+p.SendMs), ms(p.BlockhashMs), ms(p.SendMs))
+	fmt.Printf("   Confirmation: %v\n", ms(p.ConfirmMs))
+	fmt.Printf("   Rate Limit Wait: %v\n", ms(p.RateLimitWaitMs))
+}
+
+// printComputeUnits summarizes the compute units of confirmed transfers
+// that reported them.
+func printComputeUnits(results []TransferResult) {
+	var units []uint64
+	confirmed := 0
+	var total uint64
+	for _, result := range results {
+		if result.Status != "Confirmed" {
+			continue
+		}
+		confirmed++
+		if result.computeUnitsRead {
+			units = append(units, result.ComputeUnits)
+			total += result.ComputeUnits
+		}
+	}
+	if len(units) == 0 {
+		if confirmed > 0 {
+			fmt.Println("Compute Units: not reported by the node")
+		}
+		return
+	}
+
+	sort.Slice(units, func(i, j int) bool { return units[i] < units[j] })
+	rank := func(p float64) uint64 {
+		i := int(math.Ceil(p/100*float64(len(units)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return units[i]
+	}
+	fmt.Printf("Compute Units: total %d, p50 %d, p90 %d, p99 %d, max %d (%d of %d confirmed reported)\n",
+		total, rank(50), rank(90), rank(99), units[len(units)-1], len(units), confirmed)
+}
+
+// missingResults returns the ids of the pending transfers that produced no
+// result, in dispatch order.
+func missingResults(pending []TransferInstruction, answered map[string]bool) []string {
+	var missing []string
+	for _, transfer := range pending {
+		if !answered[transfer.ID] {
+			missing = append(missing, transfer.ID)
+		}
+	}
+	return missing
+}
+
+// formatIDs joins up to limit ids, noting how many more there are.
+func formatIDs(ids []string, limit int) string {
+	if len(ids) <= limit {
+		return strings.Join(ids, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(ids[:limit], ", "), len(ids)-limit)
+}
+
+// formatCounts renders counts as "reason: n, reason: n" in a stable order.
+func formatCounts(reasons map[string]int) string {
+	keys := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		keys = append(keys, reason)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, reason := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %d", reason, reasons[reason]))
+	}
+	return strings.Join(parts, ", ")
+}
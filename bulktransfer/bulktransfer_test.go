@@ -0,0 +1,130 @@
+package bulktransfer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCollectRound(t *testing.T) {
+	tests := []struct {
+		name      string
+		n, k      int
+		duplicate bool
+		retryable bool
+	}{
+		{name: "all results", n: 5, k: 5},
+		{name: "closed early", n: 5, k: 3},
+		{name: "closed before any result", n: 4, k: 0},
+		{name: "no transfers", n: 0, k: 0},
+		{name: "second result ignored", n: 3, k: 2, duplicate: true},
+		{name: "failures deferred", n: 4, k: 4, retryable: true},
+		{name: "deferred and closed early", n: 4, k: 1, retryable: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pending := make([]TransferInstruction, test.n)
+			for i := range pending {
+				pending[i].ID = fmt.Sprint(i)
+			}
+
+			results := make(chan TransferResult, test.k+1)
+			for i := 0; i < test.k; i++ {
+				result := TransferResult{ID: pending[i].ID, Status: "Confirmed"}
+				if test.retryable && i%2 == 0 {
+					result = TransferResult{ID: pending[i].ID, Error: errors.New("connection reset")}
+				}
+				results <- result
+			}
+			if test.duplicate {
+				results <- TransferResult{ID: pending[0].ID, Status: "Confirmed"}
+			}
+			close(results)
+
+			deferrable := func(result TransferResult) bool { return result.Error != nil }
+			var final, handledDeferred int
+			deferred, missing := collectRound(results, pending, deferrable, func(result TransferResult, deferred bool) {
+				if deferred {
+					handledDeferred++
+				} else {
+					final++
+				}
+			})
+
+			if len(missing) != test.n-test.k {
+				t.Errorf("missing = %d (%v), want %d", len(missing), missing, test.n-test.k)
+			}
+			for i, id := range missing {
+				if want := pending[test.k+i].ID; id != want {
+					t.Errorf("missing[%d] = %s, want %s", i, id, want)
+				}
+			}
+			if len(deferred) != handledDeferred {
+				t.Errorf("deferred = %d, handled as deferred %d", len(deferred), handledDeferred)
+			}
+			if final+len(deferred) != test.k {
+				t.Errorf("final %d + deferred %d, want %d results", final, len(deferred), test.k)
+			}
+		})
+	}
+}
+
+func TestMissingResults(t *testing.T) {
+	pending := []TransferInstruction{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	tests := []struct {
+		answered []string
+		want     int
+	}{
+		{nil, 3},
+		{[]string{"b"}, 2},
+		{[]string{"a", "b", "c"}, 0},
+		{[]string{"x"}, 3},
+	}
+
+	for _, test := range tests {
+		answered := make(map[string]bool)
+		for _, id := range test.answered {
+			answered[id] = true
+		}
+		if got := missingResults(pending, answered); len(got) != test.want {
+			t.Errorf("missingResults(%v) = %v, want %d ids", test.answered, got, test.want)
+		}
+	}
+}
+
+func TestPlanPercentAmounts(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 64))
+	config := &Config{}
+	fixed := TransferInstruction{ID: "fixed", FromPrivateKey: key, Amount: 1000}
+	percent := TransferInstruction{ID: "percent", FromPrivateKey: key, Percent: 50}
+	reserve := transferFeeReserve(config, &fixed)
+
+	tests := []struct {
+		name      string
+		transfers []TransferInstruction
+		senders   int
+		committed uint64
+	}{
+		{name: "fixed only", transfers: []TransferInstruction{fixed}, senders: 0, committed: 1000 + reserve},
+		{name: "fixed then percent", transfers: []TransferInstruction{fixed, percent}, senders: 1, committed: 1000 + 2*reserve},
+		{name: "percent then fixed", transfers: []TransferInstruction{percent, fixed}, senders: 1, committed: 1000 + 2*reserve},
+		{name: "two percent", transfers: []TransferInstruction{percent, percent}, senders: 1, committed: 2 * reserve},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan, err := planPercentAmounts(config, test.transfers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.percentSenders) != test.senders {
+				t.Fatalf("got %d percent senders, want %d", len(plan.percentSenders), test.senders)
+			}
+			if got := plan.committed[plan.senders[0]]; got != test.committed {
+				t.Errorf("committed %d lamports, want %d", got, test.committed)
+			}
+		})
+	}
+}
@@ -7,8 +7,11 @@ require (
 	github.com/jito-labs/geyser-grpc-plugin v0.9.0
 	github.com/spf13/viper v1.16.0
 	google.golang.org/grpc v1.57.0
+	solanakey v0.0.0
 )
 
+replace solanakey => ./solanakey
+
 require (
 	contrib.go.opencensus.io/exporter/stackdriver v0.13.4 // indirect
 	filippo.io/edwards25519 v1.0.0-rc.1 // indirect
@@ -3,21 +3,31 @@ package main
 import (
 	"context"
 	"crypto/ed25519"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"solanakey"
+
 	"github.com/gagliardetto/solana-go"
 	"github.com/gagliardetto/solana-go/rpc"
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	geyser "github.com/jito-labs/geyser-grpc-plugin/gen/geyser"
 )
@@ -29,9 +39,83 @@ type Config struct {
 	GeyserURL     string `mapstructure:"geyser_url"`
 	APIKey        string `mapstructure:"api_key"`
 	RpcURL        string `mapstructure:"rpc_url"`
+
+	// Формат private_key: base64, base58 (как экспортирует Phantom), file
+	// (путь к файлу ключа Solana CLI) или auto (по умолчанию) - определить сам
+	KeyFormat string `mapstructure:"key_format"`
+
+	// Частота отправки по слотам: не чаще раза в min_slots_between_sends
+	// слотов (0 или 1 - на каждый слот) и не больше max_sends транзакций
+	// (0 - без ограничения), после чего программа завершается
+	MinSlotsBetweenSends uint64 `mapstructure:"min_slots_between_sends"`
+	MaxSends             int    `mapstructure:"max_sends"`
+
+	// Режим автоматического вывода: при балансе watch_account выше threshold
+	// излишек отправляется на sweep_destination
+	WatchAccount     string `mapstructure:"watch_account"`
+	Threshold        uint64 `mapstructure:"threshold"`
+	SweepDestination string `mapstructure:"sweep_destination"`
+
+	// Проверка соединения gRPC: пинг каждые keepalive_seconds (по умолчанию
+	// 10) с ожиданием ответа keepalive_timeout_seconds (по умолчанию 5).
+	// Если за stream_idle_timeout_seconds (по умолчанию 30) не пришло ни
+	// одного слота, поток считается зависшим и переподключается; в режиме
+	// вывода тишина нормальна, и зависание обнаруживает только keepalive.
+	KeepaliveSeconds         int `mapstructure:"keepalive_seconds"`
+	KeepaliveTimeoutSeconds  int `mapstructure:"keepalive_timeout_seconds"`
+	StreamIdleTimeoutSeconds int `mapstructure:"stream_idle_timeout_seconds"`
+
+	// Подключение при запуске: каждая попытка ограничена
+	// dial_timeout_seconds (по умолчанию 10), всего dial_attempts попыток
+	// (по умолчанию 5) с удваивающейся паузой между ними
+	DialTimeoutSeconds int `mapstructure:"dial_timeout_seconds"`
+	DialAttempts       int `mapstructure:"dial_attempts"`
+
+	// Повтор отправки транзакции при временной ошибке узла: не больше
+	// max_retries раз (по умолчанию 0) с удваивающейся паузой
+	MaxRetries int `mapstructure:"max_retries"`
+
+	// Возобновление с определённого слота, если сервер поддерживает
+	// from_slot: последний обработанный слот сохраняется в slot_state_file,
+	// и после переподключения или перезапуска обработка продолжается со
+	// следующего. from_slot задаёт начальный слот, если файла ещё нет.
+	FromSlot      uint64 `mapstructure:"from_slot"`
+	SlotStateFile string `mapstructure:"slot_state_file"`
+}
+
+// secondsOr возвращает seconds в виде длительности или fallback, если не задано
+func secondsOr(seconds int, fallback time.Duration) time.Duration {
+	if seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// bindEnv позволяет задать любой параметр переменной окружения GEYSER_<КЛЮЧ>,
+// например GEYSER_API_KEY; она имеет приоритет над файлом конфигурации
+func bindEnv() {
+	viper.SetEnvPrefix("geyser")
+	config := reflect.TypeOf(Config{})
+	for i := 0; i < config.NumField(); i++ {
+		if key := config.Field(i).Tag.Get("mapstructure"); key != "" {
+			viper.BindEnv(key)
+		}
+	}
+}
+
+// redactKey скрывает секрет для логов, оставляя последние 4 символа
+func redactKey(key string) string {
+	if key == "" {
+		return "(not set)"
+	}
+	if len(key) <= 8 {
+		return "****"
+	}
+	return "****" + key[len(key)-4:]
 }
 
 func loadConfig() (*Config, error) {
+	bindEnv()
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
@@ -60,16 +144,14 @@ func main() {
 	defer cancel()
 
 	// Добавление метаданных для авторизации
+	log.Printf("Connecting to %s with API key %s", config.GeyserURL, redactKey(config.APIKey))
 	md := metadata.New(map[string]string{
 		"x-api-key": config.APIKey,
 	})
 	ctx = metadata.NewOutgoingContext(ctx, md)
 
 	// Создание соединения gRPC
-	conn, err := grpc.Dial(
-		config.GeyserURL,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	)
+	conn, err := dialGeyser(ctx, config)
 	if err != nil {
 		log.Fatalf("Failed to connect to gRPC server: %v", err)
 	}
@@ -78,19 +160,21 @@ func main() {
 	// Создание клиента gRPC
 	client := geyser.NewGeyserClient(conn)
 
-	// Подготовка запроса на подписку
+	// Подготовка запроса на подписку: на слоты или на изменения
+	// отслеживаемого аккаунта в режиме вывода
 	request := &geyser.SubscribeRequest{
 		Slots: &geyser.SubscribeRequestSlots{},
 	}
-
-	// Подписка на события
-	stream, err := client.Subscribe(ctx, request)
-	if err != nil {
-		log.Fatalf("Failed to subscribe: %v", err)
+	if config.WatchAccount != "" {
+		request = &geyser.SubscribeRequest{
+			Accounts: map[string]*geyser.SubscribeRequestFilterAccounts{
+				"sweep": {Account: []string{config.WatchAccount}},
+			},
+		}
 	}
 
 	// Декодирование приватного ключа
-	privateKeyBytes, err := base64.StdEncoding.DecodeString(config.PrivateKey)
+	privateKeyBytes, err := solanakey.Decode(config.PrivateKey, config.KeyFormat)
 	if err != nil {
 		log.Fatalf("Failed to decode private key: %v", err)
 	}
@@ -98,57 +182,622 @@ func main() {
 	// Создание клиента Solana RPC
 	solanaClient := rpc.New(config.RpcURL)
 
+	// Один blockhash на все транзакции вместо запроса на каждый слот
+	blockhashes, err := newBlockhashCache(ctx, solanaClient)
+	if err != nil {
+		log.Fatalf("Failed to get latest blockhash: %v", err)
+	}
+
+	var sweep *sweeper
+	if config.WatchAccount != "" {
+		sweep, err = newSweeper(ctx, solanaClient, blockhashes, privateKeyBytes, config)
+		if err != nil {
+			log.Fatalf("Invalid sweep configuration: %v", err)
+		}
+		log.Printf("Sweeping balance of %s above %d lamports to %s", config.WatchAccount, config.Threshold, config.SweepDestination)
+	}
+
 	// Создание обработчика сигналов для корректного завершения
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 
 	log.Println("Started listening for new blocks...")
 
-	// Основной цикл обработки событий
+	// Последний полностью обработанный слот, с которого продолжать
+	lastSlot := config.FromSlot
+	if lastSlot > 0 {
+		lastSlot--
+	}
+	if config.SlotStateFile != "" {
+		saved, err := loadLastSlot(config.SlotStateFile)
+		if err != nil {
+			log.Fatalf("Failed to load slot state: %v", err)
+		}
+		if saved > 0 {
+			lastSlot = saved
+			log.Printf("Resuming after slot %d from %s", lastSlot, config.SlotStateFile)
+		}
+	}
+
+	// markProcessed запоминает слот обработанного события
+	markProcessed := func(slot uint64) {
+		if slot <= lastSlot {
+			return
+		}
+		lastSlot = slot
+		if config.SlotStateFile != "" {
+			if err := saveLastSlot(config.SlotStateFile, slot); err != nil {
+				log.Printf("Failed to save slot state: %v", err)
+			}
+		}
+	}
+
+	// Слот последней отправки и число успешных отправок
+	var lastSendSlot uint64
+	sends := 0
+	finished := make(chan struct{})
+
+	// Обработка одного события
+	handleUpdate := func(update *geyser.SubscribeUpdate) {
+		if sweep != nil {
+			if accountUpdate := update.GetAccount(); accountUpdate != nil && accountUpdate.Account != nil {
+				sweep.handleUpdate(accountUpdate.Account.Lamports, accountUpdate.Slot)
+				markProcessed(accountUpdate.Slot)
+			}
+			return
+		}
+
+		if slotUpdate := update.GetSlot(); slotUpdate != nil {
+			slot := slotUpdate.Slot
+			// Geyser присылает слот повторно (для каждого статуса) и не
+			// всегда по порядку
+			if slot <= lastSlot {
+				return
+			}
+			log.Printf("New block detected at slot: %d", slot)
+			if config.MaxSends > 0 && sends >= config.MaxSends {
+				return
+			}
+			if lastSendSlot > 0 && slot-lastSendSlot < config.MinSlotsBetweenSends {
+				markProcessed(slot)
+				return
+			}
+			lastSendSlot = slot
+
+			// Отправка транзакции
+			_, _, err := sendTransaction(ctx, solanaClient, blockhashes, privateKeyBytes, config.RecipientAddr, config.Amount, config.MaxRetries)
+			if err != nil {
+				log.Printf("Failed to send transaction: %v", err)
+			} else {
+				sends++
+				log.Printf("Transaction sent successfully for block at slot: %d", slot)
+			}
+			markProcessed(slot)
+
+			if config.MaxSends > 0 && sends == config.MaxSends {
+				log.Printf("Sent %d transactions (max_sends), stopping", sends)
+				close(finished)
+			}
+		}
+	}
+
+	// Основной цикл обработки событий с переподключением при обрыве
+	// или зависании потока
+	idleTimeout := secondsOr(config.StreamIdleTimeoutSeconds, 30*time.Second)
+	if sweep != nil {
+		// Баланс может не меняться часами: без обновлений аккаунта поток не
+		// зависший, а слоты, по которым это видно, в режиме вывода не приходят
+		idleTimeout = 0
+	}
 	go func() {
 		for {
-			update, err := stream.Recv()
-			if err != nil {
-				log.Printf("Error receiving update: %v", err)
-				cancel()
+			// События, пропущенные за время обрыва, приходят повторно
+			if lastSlot > 0 {
+				fromSlot := lastSlot + 1
+				request.FromSlot = &fromSlot
+			}
+			err := subscribe(ctx, client, request, idleTimeout, handleUpdate)
+			if ctx.Err() != nil {
 				return
 			}
 
-			if slotUpdate := update.GetSlot(); slotUpdate != nil {
-				slot := slotUpdate.Slot
-				log.Printf("New block detected at slot: %d", slot)
+			// С неверным ключом или запросом переподключаться бесполезно
+			category, fatal := classifyStreamError(err)
+			if fatal {
+				log.Fatalf("Stream failed with %s error, not reconnecting: %v", category, err)
+			}
+			delay := reconnectDelay
+			if category == "quota" {
+				delay = quotaReconnectDelay
+			}
+			log.Printf("Error receiving update (%s): %v, reconnecting in %v", category, err, delay)
 
-				// Отправка транзакции
-				err := sendTransaction(solanaClient, privateKeyBytes, config.RecipientAddr, config.Amount)
-				if err != nil {
-					log.Printf("Failed to send transaction: %v", err)
-				} else {
-					log.Printf("Transaction sent successfully for block at slot: %d", slot)
-				}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
 			}
 		}
 	}()
 
-	// Ожидание сигнала завершения
-	<-signalCh
+	// Ожидание сигнала завершения или исчерпания max_sends
+	select {
+	case <-signalCh:
+	case <-finished:
+	}
 	log.Println("Shutting down...")
 }
 
-func sendTransaction(client *rpc.Client, privateKeyBytes []byte, recipientAddr string, amount uint64) error {
-	// Создание пары ключей из приватного ключа
+// dialRetryDelay - пауза перед второй попыткой подключения, далее удваивается
+const dialRetryDelay = time.Second
+
+// dialGeyser подключается к geyser_url, дожидаясь установки соединения, с
+// таймаутом на попытку и повторами. keepalive обнаруживает мёртвое, но не
+// закрытое соединение уже после подключения.
+func dialGeyser(ctx context.Context, config *Config) (*grpc.ClientConn, error) {
+	timeout := secondsOr(config.DialTimeoutSeconds, 10*time.Second)
+	attempts := config.DialAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+
+	delay := dialRetryDelay
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err := grpc.DialContext(
+			dialCtx,
+			config.GeyserURL,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                secondsOr(config.KeepaliveSeconds, 10*time.Second),
+				Timeout:             secondsOr(config.KeepaliveTimeoutSeconds, 5*time.Second),
+				PermitWithoutStream: true,
+			}),
+			grpc.WithBlock(),
+			grpc.WithReturnConnectionError(),
+		)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+
+		if attempt == attempts {
+			break
+		}
+		log.Printf("Failed to connect to %s (attempt %d of %d): %v, retrying in %v", config.GeyserURL, attempt, attempts, err, delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return nil, fmt.Errorf("%s unreachable after %d attempts of %v: %w", config.GeyserURL, attempts, timeout, lastErr)
+}
+
+// loadLastSlot читает сохранённый последний обработанный слот; отсутствие
+// файла означает, что сохранённого слота нет
+func loadLastSlot(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	slot, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid slot in %s: %w", path, err)
+	}
+	return slot, nil
+}
+
+// saveLastSlot сохраняет слот через временный файл, чтобы при сбое не
+// остался недописанный файл
+func saveLastSlot(path string, slot uint64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(slot, 10)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reconnectDelay - пауза перед повторной подпиской после обрыва потока,
+// quotaReconnectDelay - после превышения квоты, чтобы не тратить её впустую
+const (
+	reconnectDelay      = 2 * time.Second
+	quotaReconnectDelay = 30 * time.Second
+)
+
+// classifyStreamError определяет по коду статуса gRPC категорию ошибки
+// подписки и то, бесполезно ли переподключаться. Ошибки без статуса
+// (например, зависший поток) считаются временными.
+func classifyStreamError(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return "transient", false
+	}
+
+	switch st.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return fmt.Sprintf("auth (%s)", st.Code()), true
+	case codes.InvalidArgument, codes.Unimplemented, codes.NotFound:
+		return fmt.Sprintf("request (%s)", st.Code()), true
+	case codes.ResourceExhausted:
+		return "quota", false
+	default:
+		return fmt.Sprintf("transient (%s)", st.Code()), false
+	}
+}
+
+// subscribe подписывается на события и передаёт их в handle, пока поток не
+// оборвётся. Если за idleTimeout (0 - без ограничения) не пришло ни одного
+// события, поток отменяется: сервер мог замолчать, не закрыв соединение.
+func subscribe(ctx context.Context, client geyser.GeyserClient, request *geyser.SubscribeRequest, idleTimeout time.Duration, handle func(*geyser.SubscribeUpdate)) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.Subscribe(streamCtx, request)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	if idleTimeout <= 0 {
+		for {
+			update, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			handle(update)
+		}
+	}
+
+	var idle int32
+	timer := time.AfterFunc(idleTimeout, func() {
+		atomic.StoreInt32(&idle, 1)
+		cancel()
+	})
+	defer timer.Stop()
+
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			if atomic.LoadInt32(&idle) == 1 {
+				return fmt.Errorf("no updates for %v", idleTimeout)
+			}
+			return err
+		}
+
+		// Время обработки не считается простоем потока
+		timer.Stop()
+		handle(update)
+		timer.Reset(idleTimeout)
+	}
+}
+
+// sweepFee - комиссия за транзакцию вывода с одной подписью
+const sweepFee = 5000
+
+// sweepConfirmTimeout - сколько ждать подтверждения вывода, прежде чем
+// снова реагировать на изменения баланса
+const sweepConfirmTimeout = 90 * time.Second
+
+// sweeper выводит излишек баланса отслеживаемого аккаунта выше порога.
+// Одновременно выполняется не больше одного вывода: обновления, пришедшие
+// до подтверждения предыдущего, ещё показывают старый баланс. Если такие
+// обновления были или вывод подтверждён, баланс перечитывается после него,
+// чтобы не пропустить поступления во время вывода.
+type sweeper struct {
+	ctx             context.Context
+	client          *rpc.Client
+	blockhashes     *blockhashCache
+	privateKeyBytes []byte
+	watched         solana.PublicKey
+	destination     string
+	threshold       uint64
+	maxRetries      int
+	inFlight        int32
+	// 1, если во время вывода пришли пропущенные обновления
+	missed int32
+}
+
+func newSweeper(ctx context.Context, client *rpc.Client, blockhashes *blockhashCache, privateKeyBytes []byte, config *Config) (*sweeper, error) {
+	watched, err := solana.PublicKeyFromBase58(config.WatchAccount)
+	if err != nil {
+		return nil, fmt.Errorf("invalid watch_account: %w", err)
+	}
+	if _, err := solana.PublicKeyFromBase58(config.SweepDestination); err != nil {
+		return nil, fmt.Errorf("invalid sweep_destination: %w", err)
+	}
+
+	// Выводить можно только с аккаунта, ключ которого указан в конфигурации
+	if owner := accountFromKey(privateKeyBytes).PublicKey(); !owner.Equals(watched) {
+		return nil, fmt.Errorf("private_key belongs to %s, not watch_account %s", owner, watched)
+	}
+
+	return &sweeper{
+		ctx:             ctx,
+		client:          client,
+		blockhashes:     blockhashes,
+		privateKeyBytes: privateKeyBytes,
+		watched:         watched,
+		destination:     config.SweepDestination,
+		threshold:       config.Threshold,
+		maxRetries:      config.MaxRetries,
+	}, nil
+}
+
+// handleUpdate выводит баланс за вычетом порога и комиссии, если он
+// достаточен и другой вывод не выполняется
+func (s *sweeper) handleUpdate(lamports uint64, slot uint64) {
+	if lamports <= s.threshold+sweepFee {
+		return
+	}
+	amount := lamports - s.threshold - sweepFee
+
+	if !atomic.CompareAndSwapInt32(&s.inFlight, 0, 1) {
+		log.Printf("Sweep already in flight, deferring balance %d at slot %d", lamports, slot)
+		atomic.StoreInt32(&s.missed, 1)
+		return
+	}
+
+	go func() {
+		log.Printf("Balance %d at slot %d is above threshold, sweeping %d lamports", lamports, slot, amount)
+		confirmed := s.sweep(amount)
+
+		// Обновления, пропущенные до этой точки, отмечены в missed, а
+		// пришедшие после неё обрабатываются сами
+		atomic.StoreInt32(&s.inFlight, 0)
+		missed := atomic.SwapInt32(&s.missed, 0) == 1
+		// После неудачного вывода без новых обновлений баланс не
+		// перечитывается, чтобы не повторять его в цикле
+		if !confirmed && !missed {
+			return
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		balance, err := s.client.GetBalance(s.ctx, s.watched, rpc.CommitmentConfirmed)
+		if err != nil {
+			log.Printf("Failed to re-read balance after sweep: %v", err)
+			return
+		}
+		s.handleUpdate(balance.Value, balance.Context.Slot)
+	}()
+}
+
+// sweep отправляет вывод amount лампортов и ждёт его подтверждения.
+// Возвращает true, если вывод подтверждён.
+func (s *sweeper) sweep(amount uint64) bool {
+	// Транзакция с истёкшим blockhash уже не пройдёт, её можно
+	// безопасно отправить заново со свежим
+	for attempt := 0; ; attempt++ {
+		sig, lastValid, err := sendTransaction(s.ctx, s.client, s.blockhashes, s.privateKeyBytes, s.destination, amount, s.maxRetries)
+		if err != nil {
+			log.Printf("Failed to sweep: %v", err)
+			return false
+		}
+
+		err = waitForConfirmation(s.ctx, s.client, sig, lastValid, sweepConfirmTimeout)
+		if errors.Is(err, errBlockhashExpired) && attempt < sweepExpiryResends {
+			log.Printf("Sweep %s expired before confirming, resending", sig)
+			if err := s.blockhashes.Refresh(s.ctx); err != nil {
+				log.Printf("Failed to sweep: %v", err)
+				return false
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Sweep %s not confirmed: %v", sig, err)
+			return false
+		}
+		log.Printf("Sweep %s confirmed", sig)
+		return true
+	}
+}
+
+// sweepExpiryResends - сколько раз повторять вывод, blockhash которого
+// истёк до подтверждения
+const sweepExpiryResends = 2
+
+// errBlockhashExpired - транзакция не подтверждена, а её blockhash истёк,
+// так что она уже не попадёт в блок
+var errBlockhashExpired = errors.New("blockhash expired before confirmation")
+
+// waitForConfirmation опрашивает статус транзакции до подтверждения,
+// ошибки транзакции, истечения её blockhash (после блока lastValid) или
+// таймаута
+func waitForConfirmation(ctx context.Context, client *rpc.Client, sig solana.Signature, lastValid uint64, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		statuses, err := client.GetSignatureStatuses(ctx, false, sig)
+		if err == nil && len(statuses.Value) > 0 && statuses.Value[0] != nil {
+			status := statuses.Value[0]
+			if status.Err != nil {
+				return fmt.Errorf("transaction failed: %v", status.Err)
+			}
+			if status.ConfirmationStatus == rpc.ConfirmationStatusConfirmed ||
+				status.ConfirmationStatus == rpc.ConfirmationStatusFinalized {
+				return nil
+			}
+		} else if err == nil {
+			// Статуса нет: если blockhash истёк, ждать бесполезно
+			height, err := client.GetBlockHeight(ctx, rpc.CommitmentConfirmed)
+			if err == nil && height > lastValid {
+				return errBlockhashExpired
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// accountFromKey создаёт аккаунт из seed приватного ключа
+func accountFromKey(privateKeyBytes []byte) *solana.Account {
 	privateKey := ed25519.NewKeyFromSeed(privateKeyBytes[:32])
-	account := solana.NewAccountFromPrivateKeyBytes(privateKey)
+	return solana.NewAccountFromPrivateKeyBytes(privateKey)
+}
+
+// blockhashRefreshInterval - как часто обновлять общий blockhash; он
+// действует около минуты (150 блоков)
+const blockhashRefreshInterval = 20 * time.Second
+
+// blockhashCache хранит последний blockhash для всех транзакций и
+// обновляет его в фоне, вместе с высотой блока, после которой он истекает
+type blockhashCache struct {
+	client *rpc.Client
+
+	mu                   sync.Mutex
+	blockhash            solana.Hash
+	lastValidBlockHeight uint64
+}
+
+// newBlockhashCache получает blockhash и запускает его обновление до
+// отмены ctx
+func newBlockhashCache(ctx context.Context, client *rpc.Client) (*blockhashCache, error) {
+	c := &blockhashCache{client: client}
+	if err := c.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(blockhashRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("Failed to refresh blockhash: %v", err)
+				}
+			}
+		}
+	}()
+	return c, nil
+}
 
-	// Получение последнего блокхеша
-	recentBlockhash, err := client.GetRecentBlockhash(context.Background(), rpc.CommitmentFinalized)
+// Get возвращает текущий blockhash и последнюю высоту блока, на которой
+// он действителен
+func (c *blockhashCache) Get() (solana.Hash, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blockhash, c.lastValidBlockHeight
+}
+
+// Refresh заменяет blockhash последним
+func (c *blockhashCache) Refresh(ctx context.Context) error {
+	latest, err := c.client.GetLatestBlockhash(ctx, rpc.CommitmentFinalized)
 	if err != nil {
-		return fmt.Errorf("failed to get recent blockhash: %w", err)
+		return fmt.Errorf("failed to get latest blockhash: %w", err)
 	}
 
+	c.mu.Lock()
+	c.blockhash = latest.Value.Blockhash
+	c.lastValidBlockHeight = latest.Value.LastValidBlockHeight
+	c.mu.Unlock()
+	return nil
+}
+
+// isBlockhashNotFound сообщает, отклонил ли узел транзакцию из-за
+// неизвестного ему (истёкшего) blockhash
+func isBlockhashNotFound(err error) bool {
+	text := err.Error()
+	return strings.Contains(text, "BlockhashNotFound") || strings.Contains(text, "Blockhash not found")
+}
+
+// sendRetryDelay - пауза перед первым повтором отправки, далее удваивается
+// до maxSendRetryDelay
+const (
+	sendRetryDelay    = 500 * time.Millisecond
+	maxSendRetryDelay = 10 * time.Second
+)
+
+// transientSendErrors - признаки временных ошибок отправки: узел перегружен,
+// недоступен или не успел ответить
+var transientSendErrors = []string{
+	"timeout", "deadline exceeded", "connection reset", "connection refused", "EOF",
+	"429", "Too Many Requests", "502", "503", "Service Unavailable", "504",
+	"Node is behind", "unhealthy", "busy",
+}
+
+// isRetryableSendError сообщает, может ли повторная отправка пройти.
+// Нехватка средств и неверная подпись при повторе не исправятся
+func isRetryableSendError(err error) bool {
+	text := err.Error()
+	for _, terminal := range []string{"InsufficientFunds", "insufficient funds", "insufficient lamports", "SignatureFailure", "signature verification"} {
+		if strings.Contains(text, terminal) {
+			return false
+		}
+	}
+	if isBlockhashNotFound(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	for _, fragment := range transientSendErrors {
+		if strings.Contains(text, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendTransaction отправляет перевод с общим blockhash и возвращает подпись
+// и высоту блока, после которой транзакция истекает. Если узел не знает
+// blockhash, он обновляется и транзакция подписывается заново; прочие
+// временные ошибки повторяются не больше maxRetries раз с удваивающейся паузой.
+func sendTransaction(ctx context.Context, client *rpc.Client, blockhashes *blockhashCache, privateKeyBytes []byte, recipientAddr string, amount uint64, maxRetries int) (solana.Signature, uint64, error) {
+	sig, lastValid, err := signAndSend(ctx, client, blockhashes, privateKeyBytes, recipientAddr, amount)
+	delay := sendRetryDelay
+	for retry := 0; err != nil && isRetryableSendError(err) && ctx.Err() == nil; retry++ {
+		// Истёкший blockhash обновляется один раз и без max_retries
+		if retry >= maxRetries && !(retry == 0 && isBlockhashNotFound(err)) {
+			break
+		}
+		if isBlockhashNotFound(err) {
+			log.Printf("Blockhash expired, retrying with a fresh one")
+			if refreshErr := blockhashes.Refresh(ctx); refreshErr != nil {
+				return solana.Signature{}, 0, refreshErr
+			}
+		} else {
+			log.Printf("Send failed (%v), retrying in %v (%d of %d)", err, delay, retry+1, maxRetries)
+			select {
+			case <-ctx.Done():
+				return solana.Signature{}, 0, ctx.Err()
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxSendRetryDelay {
+				delay = maxSendRetryDelay
+			}
+		}
+		sig, lastValid, err = signAndSend(ctx, client, blockhashes, privateKeyBytes, recipientAddr, amount)
+	}
+	return sig, lastValid, err
+}
+
+func signAndSend(ctx context.Context, client *rpc.Client, blockhashes *blockhashCache, privateKeyBytes []byte, recipientAddr string, amount uint64) (solana.Signature, uint64, error) {
+	// Создание пары ключей из приватного ключа
+	account := accountFromKey(privateKeyBytes)
+
+	// Текущий blockhash из кэша
+	recentBlockhash, lastValid := blockhashes.Get()
+
 	// Парсинг адреса получателя
 	recipient, err := solana.PublicKeyFromBase58(recipientAddr)
 	if err != nil {
-		return fmt.Errorf("invalid recipient address: %w", err)
+		return solana.Signature{}, 0, fmt.Errorf("invalid recipient address: %w", err)
 	}
 
 	// Создание транзакции
@@ -160,11 +809,11 @@ func sendTransaction(client *rpc.Client, privateKeyBytes []byte, recipientAddr s
 				recipient,
 			).Build(),
 		},
-		recentBlockhash.Value.Blockhash,
+		recentBlockhash,
 		solana.TransactionPayer(account.PublicKey()),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create transaction: %w", err)
+		return solana.Signature{}, 0, fmt.Errorf("failed to create transaction: %w", err)
 	}
 
 	// Подписание транзакции
@@ -177,12 +826,12 @@ func sendTransaction(client *rpc.Client, privateKeyBytes []byte, recipientAddr s
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to sign transaction: %w", err)
+		return solana.Signature{}, 0, fmt.Errorf("failed to sign transaction: %w", err)
 	}
 
 	// Отправка транзакции
 	sig, err := client.SendTransactionWithOpts(
-		context.Background(),
+		ctx,
 		tx,
 		rpc.TransactionOpts{
 			SkipPreflight:       false,
@@ -190,9 +839,9 @@ func sendTransaction(client *rpc.Client, privateKeyBytes []byte, recipientAddr s
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to send transaction: %w", err)
+		return solana.Signature{}, 0, fmt.Errorf("failed to send transaction: %w", err)
 	}
 
 	log.Printf("Transaction sent with signature: %s", sig.String())
-	return nil
+	return sig, lastValid, nil
 }
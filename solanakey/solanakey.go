@@ -0,0 +1,72 @@
+// Package solanakey parses Solana private keys the same way for
+// bulk-sol-transfer and the geyser tool.
+package solanakey
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+// ReadKeypair reads the 64 secret key bytes of a Solana CLI keypair file, a
+// JSON array of byte values.
+func ReadKeypair(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keypair file: %w", err)
+	}
+
+	var secret []byte
+	var values []int
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s is not a keypair file: %w", path, err)
+	}
+	for _, value := range values {
+		if value < 0 || value > 255 {
+			return nil, fmt.Errorf("%s is not a keypair file: byte value %d out of range", path, value)
+		}
+		secret = append(secret, byte(value))
+	}
+	if len(secret) != 64 {
+		return nil, fmt.Errorf("%s is not a keypair file: %d bytes, expected 64", path, len(secret))
+	}
+	return secret, nil
+}
+
+// Decode decodes a private key in format: "base64", "base58", "file" for the
+// path of a Solana CLI keypair file, or "auto" (or empty), which takes an
+// existing file, then a base58 key and then base64.
+func Decode(key, format string) ([]byte, error) {
+	var secret []byte
+	var err error
+	switch format {
+	case "", "auto":
+		if info, statErr := os.Stat(key); statErr == nil && !info.IsDir() {
+			return ReadKeypair(key)
+		}
+		// Base64 keys of 64 bytes end in "==", which is not base58
+		if secret, err := solana.PrivateKeyFromBase58(key); err == nil && len(secret) == 64 {
+			return secret, nil
+		}
+		format = "base64"
+		secret, err = base64.StdEncoding.DecodeString(key)
+	case "base64":
+		secret, err = base64.StdEncoding.DecodeString(key)
+	case "base58":
+		secret, err = solana.PrivateKeyFromBase58(key)
+	case "file":
+		return ReadKeypair(key)
+	default:
+		return nil, fmt.Errorf("invalid key_format %q (expected base64, base58, file or auto)", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("private key is not valid %s: %w", format, err)
+	}
+	if len(secret) != 64 {
+		return nil, fmt.Errorf("private key is %d bytes, expected 64", len(secret))
+	}
+	return secret, nil
+}